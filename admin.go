@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/horsley/svrkit"
+)
+
+const metaAdminPrefix = "/_meta"
+
+var allMetaKeys = []MetaKey{MetaWriteKey, MetaIPCheck, MetaReadAuth, MetaContentType, MetaNoIndex, MetaVersions, MetaIPGroups, MetaClientCert, MetaMaxSize, MetaQuota, MetaLinkSecret, MetaTTL, MetaExpiresAt, MetaKeys, MetaPrevKey}
+
+// secret 是否 key 类的配置项，只有路径当前的 key 能查看和修改
+func (k MetaKey) secret() bool {
+	return k == MetaWriteKey || k == MetaKeys || k == MetaPrevKey
+}
+
+// managed 由服务端维护的配置项，只能查看，key_previous 只能通过轮换写入，否则旧 key 能给自己续期
+func (k MetaKey) managed() bool {
+	return k == MetaPrevKey
+}
+
+type metaValue struct {
+	Key   MetaKey
+	Value string
+	Own   bool
+}
+
+// metaAdminHandler 管理路径 meta，GET/PUT/DELETE /_meta/<path>?key=ip_check，
+// PUT/DELETE /_meta/<path>?key=keys&name=ci 单独添加或吊销一个命名 key，POST /_meta/<path>?rotate 轮换 key
+func (s *server) metaAdminHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+	targetPath := strings.TrimPrefix(r.URL.Path, metaAdminPrefix)
+	targetMeta := s.MetaOf(targetPath)
+	if !targetMeta.Valid() {
+		rw.WriteCommonResponse(403, "非法目标", nil)
+		return
+	}
+
+	k, name := MetaKey(r.URL.Query().Get("key")), r.URL.Query().Get("name")
+	if k != "" && !k.Valid() {
+		rw.WriteCommonResponse(400, "未知配置项", nil)
+		return
+	}
+
+	authMeta := targetMeta
+	if k == MetaWriteKey && r.Method != "GET" {
+		authMeta = targetMeta.Parent() //子路径的 key 只能由上级 key 下发
+	}
+	auth, err := s.authorize(r, authMeta, ScopeMeta)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+	if auth.restricted() && (k.secret() || r.URL.Query().Has("rotate")) {
+		writeAuthError(rw, errKeyNotAdmin)
+		return
+	}
+	if k.managed() && r.Method != "GET" {
+		rw.WriteCommonResponse(403, "该配置项由服务端维护", nil)
+		return
+	}
+	if r.URL.Query().Has("rotate") {
+		s.rotateKeyHandler(rw, r, targetMeta, auth)
+		return
+	}
+	entry := s.newAuditEntry(r, targetMeta, auth, false)
+	entry.MetaKey = k
+
+	switch r.Method {
+	case "GET":
+		if k != "" {
+			rw.WriteCommonResponse(0, "", readMetaValue(targetMeta, k))
+			return
+		}
+
+		var result []metaValue
+		for _, k := range allMetaKeys {
+			if auth.restricted() && k.secret() {
+				continue
+			}
+			if v := readMetaValue(targetMeta, k); v != nil {
+				result = append(result, *v)
+			}
+		}
+		rw.WriteCommonResponse(0, "", result)
+	case "PUT", "POST":
+		if k == "" {
+			rw.WriteCommonResponse(400, "缺少配置项", nil)
+			return
+		}
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			rw.WriteCommonResponse(400, "读取内容失败", nil)
+			return
+		}
+		var nk namedKey
+		if k == MetaKeys && name != "" { //单独添加或替换一个命名 key
+			if err = json.Unmarshal(content, &nk); err == nil {
+				err = validateNamedKey(name, &nk)
+			}
+		} else {
+			err = k.Validate(content)
+		}
+		if err != nil {
+			rw.WriteCommonResponse(400, "配置格式错误:"+err.Error(), nil)
+			return
+		}
+
+		switch {
+		case k == MetaWriteKey: //直接替换 key 时旧 key 立即失效
+			if old, own := targetMeta.GetText(MetaWriteKey, false); own && old != string(content) {
+				_, err = targetMeta.RotateKey(string(content), 0)
+			} else {
+				err = targetMeta.SetWriteKey(string(content))
+			}
+		case k == MetaKeys && name != "":
+			err = targetMeta.SetNamedKey(name, &nk)
+		case k == MetaReadAuth: //明文密码不落盘
+			users, _ := parseBasicAuth(content)
+			err = targetMeta.SetBasicAuth(users)
+		default:
+			err = targetMeta.Set(k, content)
+		}
+		if err != nil {
+			log.Println("Set meta err:", err, targetPath, k)
+			rw.WriteCommonResponse(500, "保存失败", nil)
+			return
+		}
+		entry.Op = AuditMetaSet
+		s.audit.Record(entry)
+		rw.WriteCommonResponse(0, "", nil)
+	case "DELETE":
+		if k == "" {
+			rw.WriteCommonResponse(400, "缺少配置项", nil)
+			return
+		}
+		if k == MetaWriteKey && targetMeta.Parent() == targetMeta {
+			rw.WriteCommonResponse(403, "不能删除根路径 key", nil)
+			return
+		}
+		if k == MetaKeys && name != "" { //单独吊销一个命名 key
+			err = targetMeta.SetNamedKey(name, nil)
+		} else if k == MetaWriteKey {
+			if err = targetMeta.Del(MetaPrevKey); err == nil {
+				err = targetMeta.Del(k)
+			}
+		} else {
+			err = targetMeta.Del(k)
+		}
+		if err != nil {
+			log.Println("Del meta err:", err, targetPath, k)
+			rw.WriteCommonResponse(500, "删除失败", nil)
+			return
+		}
+		entry.Op = AuditMetaDel
+		s.audit.Record(entry)
+		rw.WriteCommonResponse(0, "", nil)
+	default:
+		rw.HTTPError(405, "method not allowed")
+	}
+}
+
+func readMetaValue(p *pathMeta, k MetaKey) *metaValue {
+	v, ok := p.GetText(k, k.Inheritable())
+	if !ok {
+		return nil
+	}
+	_, own := p.Get(k, false)
+	return &metaValue{Key: k, Value: v, Own: own}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/horsley/faas/tool"
+)
+
+func doMetaAdmin(t *testing.T, method, url, key, body string) (int, json.RawMessage) {
+	mockReq, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if key != "" {
+		tool.SignUpload(key, mockReq)
+	}
+
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, mockReq)
+
+	var resp struct {
+		Code int
+		Data json.RawMessage
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal("bad response:", rec.Body.String())
+	}
+	return resp.Code, resp.Data
+}
+
+func TestMetaAdmin(t *testing.T) {
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	defer testServer.MetaOf("/admin_test").Destroy()
+
+	if code, _ := doMetaAdmin(t, "PUT", "http://abc.com/_meta/admin_test?key=ip_check", "", `["1.2.3.4"]`); code != 401 {
+		t.Error("unsigned request accepted", code)
+	}
+
+	if code, _ := doMetaAdmin(t, "PUT", "http://abc.com/_meta/admin_test?key=ip_check", peekRootKey, `1.2.3.4`); code != 400 {
+		t.Error("bad ip_check format accepted", code)
+	}
+
+	if code, _ := doMetaAdmin(t, "PUT", "http://abc.com/_meta/admin_test?key=whatever", peekRootKey, `x`); code != 400 {
+		t.Error("unknown key accepted", code)
+	}
+
+	if code, _ := doMetaAdmin(t, "PUT", "http://abc.com/_meta/admin_test?key=ip_check", peekRootKey, `["1.2.3.4"]`); code != 0 {
+		t.Error("set ip_check failed", code)
+	}
+
+	code, data := doMetaAdmin(t, "GET", "http://abc.com/_meta/admin_test/sub?key=ip_check", peekRootKey, "")
+	var v metaValue
+	json.Unmarshal(data, &v)
+	if code != 0 || v.Value != `["1.2.3.4"]` || v.Own {
+		t.Error("unexpected inherited value", code, string(data))
+	}
+
+	if code, _ := doMetaAdmin(t, "DELETE", "http://abc.com/_meta/admin_test?key=ip_check", peekRootKey, ""); code != 0 {
+		t.Error("delete ip_check failed", code)
+	}
+	if _, ok := testServer.MetaOf("/admin_test").Get(MetaIPCheck, false); ok {
+		t.Error("ip_check not deleted")
+	}
+}
+
+func TestMetaAdmin_DelegateKey(t *testing.T) {
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	defer testServer.MetaOf("/admin_test").Destroy()
+
+	if code, _ := doMetaAdmin(t, "PUT", "http://abc.com/_meta/admin_test?key=key", peekRootKey, "sub-key"); code != 0 {
+		t.Error("delegate key failed", code)
+	}
+
+	if code, _ := doMetaAdmin(t, "PUT", "http://abc.com/_meta/admin_test?key=key", "sub-key", "other-key"); code != 401 {
+		t.Error("sub key holder changed own key", code)
+	}
+
+	if code, _ := doMetaAdmin(t, "PUT", "http://abc.com/_meta/admin_test/deeper?key=key", "sub-key", "deeper-key"); code != 0 {
+		t.Error("sub key holder cannot delegate", code)
+	}
+
+	if code, _ := doMetaAdmin(t, "PUT", "http://abc.com/_meta/admin_test?key=no_index", "sub-key", "1"); code != 0 {
+		t.Error("sub key holder cannot manage own meta", code)
+	}
+
+	if code, _ := doMetaAdmin(t, "DELETE", "http://abc.com/_meta/?key=key", peekRootKey, ""); code != 403 {
+		t.Error("root key deleted", code)
+	}
+}
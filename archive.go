@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/horsley/svrkit"
+)
+
+// 目录打包下载支持的格式
+const (
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// readChecker 不输出响应的读权限检查，打包目录时逐个文件判断，
+// 和 readFileHandler 一样检查 basic_auth、ip_check 和 client_cert
+type readChecker struct {
+	srv        *server
+	user, pass string
+	hasAuth    bool
+	ip         string
+	tls        *tls.ConnectionState
+	byLink     bool //已通过下载链接校验，链接覆盖整个目录
+
+	authCache map[string]bool //basic_auth 原文 -> 是否通过，避免每个文件都算一次 bcrypt
+}
+
+func (s *server) newReadChecker(r *svrkit.Request) *readChecker {
+	c := &readChecker{srv: s, ip: s.clientIP(r), tls: r.TLS, byLink: r.URL.Query().Has("sig"), authCache: make(map[string]bool)}
+	c.user, c.pass, c.hasAuth = r.BasicAuth()
+	return c
+}
+
+func (c *readChecker) Allowed(p *pathMeta) bool {
+	if c.byLink {
+		return true
+	}
+	if raw, ok := p.Get(MetaReadAuth, true); ok {
+		allowed, cached := c.authCache[string(raw)]
+		if !cached {
+			users := p.GetBasicAuth()
+			allowed = users == nil || (c.hasAuth && c.srv.checkBasicAuth(users, c.user, c.pass))
+			c.authCache[string(raw)] = allowed
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if ipChecker := p.GetIPChecker(); ipChecker != nil && !ipChecker(c.ip) {
+		return false
+	}
+	if certChecker := p.GetClientCertChecker(); certChecker != nil && !certChecker(c.tls) {
+		return false
+	}
+	return true
+}
+
+// archiveWriter 打包输出，tar.gz 和 zip 共用
+type archiveWriter interface {
+	WriteFile(name string, info fs.FileInfo, rd io.Reader) error
+	Close() error
+}
+
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (w *tarGzWriter) WriteFile(name string, info fs.FileInfo, rd io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(w.tw, rd)
+	return err
+}
+
+func (w *tarGzWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) WriteFile(name string, info fs.FileInfo, rd io.Reader) error {
+	fw, err := w.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, rd)
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+// archiveHandler 把目录打包输出，GET /dir/?archive=tar.gz|zip。
+// 请求者按单个文件读不到的文件（basic_auth、ip_check、client_cert 不通过）以及 no_index 的子目录都会跳过，
+// 通过下载链接访问时只跳过 no_index 的子目录；
+// 边打包边输出，中途出错时客户端只会收到不完整的压缩包
+func (s *server) archiveHandler(rw *svrkit.ResponseWriter, r *svrkit.Request, dirMeta *pathMeta, format string) {
+	name := path.Base(dirMeta.Path())
+	if dirMeta.Parent() == dirMeta {
+		name = "root"
+	}
+
+	var aw archiveWriter
+	switch format {
+	case ArchiveTarGz:
+		rw.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(rw)
+		aw = &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}
+	case ArchiveZip:
+		rw.Header().Set("Content-Type", "application/zip")
+		aw = &zipWriter{zw: zip.NewWriter(rw)}
+	default:
+		rw.WriteCommonResponse(400, "不支持的压缩格式", nil)
+		return
+	}
+	rw.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+format+`"`)
+
+	checker := s.newReadChecker(r)
+	contentDir := dirMeta.ContentName()
+	err := walkStorage(s.storage, contentDir, func(fileName string, _ fs.FileInfo) error {
+		rel := strings.TrimPrefix(fileName, contentDir+"/")
+		fileMeta := s.MetaOf(path.Join(dirMeta.Path(), rel))
+		if fileMeta == nil {
+			return nil
+		}
+		if noIndex, _ := fileMeta.Parent().GetText(MetaNoIndex, true); noIndex != "" {
+			return nil
+		}
+		if !checker.Allowed(fileMeta) || fileMeta.Expired() {
+			return nil
+		}
+
+		f, err := s.storage.Open(fileName)
+		if err != nil { //打包期间被删除
+			return nil
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return nil
+		}
+		return aw.WriteFile(rel, info, f)
+	})
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		log.Println("Archive dir err:", err, dirMeta.Path())
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/horsley/svrkit"
+)
+
+func downloadArchive(t *testing.T, target string, user, pass string) (*httptest.ResponseRecorder, map[string]string) {
+	mockReq, _ := http.NewRequest("GET", "http://abc.com"+target, nil)
+	if user != "" {
+		mockReq.SetBasicAuth(user, pass)
+	}
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+
+	files := make(map[string]string)
+	switch rec.Header().Get("Content-Type") {
+	case "application/gzip":
+		gz, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			bin, _ := io.ReadAll(tr)
+			files[hdr.Name] = string(bin)
+		}
+	case "application/zip":
+		zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, zf := range zr.File {
+			rd, _ := zf.Open()
+			bin, _ := io.ReadAll(rd)
+			rd.Close()
+			files[zf.Name] = string(bin)
+		}
+	}
+	return rec, files
+}
+
+func fileNames(files map[string]string) string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestArchiveDownload(t *testing.T) {
+	defer testServer.MetaOf("/archive_test").Destroy()
+	testServer.MetaOf("/archive_test/a.txt").SaveContent(strings.NewReader("a"))
+	testServer.MetaOf("/archive_test/sub/b.txt").SaveContent(strings.NewReader("b"))
+	testServer.MetaOf("/archive_test/hidden/c.txt").SaveContent(strings.NewReader("c"))
+	testServer.MetaOf("/archive_test/nolist/d.txt").SaveContent(strings.NewReader("d"))
+
+	hash, _ := hashPassword("secret")
+	testServer.MetaOf("/archive_test/sub").Set(MetaReadAuth, []byte("user:"+hash))
+	testServer.MetaOf("/archive_test/hidden").Set(MetaIPCheck, []byte(`["10.0.0.1"]`))
+	testServer.MetaOf("/archive_test/nolist").Set(MetaNoIndex, []byte("1"))
+
+	rec, files := downloadArchive(t, "/archive_test/?archive=tar.gz", "", "")
+	if names := fileNames(files); names != "a.txt" {
+		t.Error("unexpected files without auth:", names)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="archive_test.tar.gz"` {
+		t.Error("unexpected Content-Disposition:", cd)
+	}
+
+	_, files = downloadArchive(t, "/archive_test/?archive=zip", "user", "secret")
+	if names := fileNames(files); names != "a.txt,sub/b.txt" {
+		t.Error("unexpected files with auth:", names)
+	}
+	if files["sub/b.txt"] != "b" {
+		t.Error("unexpected content:", files["sub/b.txt"])
+	}
+
+	if rec, _ := downloadArchive(t, "/archive_test/?archive=rar", "", ""); rec.Body.String() != `{"Code":400,"Data":null,"Message":"不支持的压缩格式"}` {
+		t.Error("unsupported format accepted:", rec.Body.String())
+	}
+}
+
+func TestArchiveDownload_DirAuth(t *testing.T) {
+	defer testServer.MetaOf("/archive_auth").Destroy()
+	testServer.MetaOf("/archive_auth/a.txt").SaveContent(strings.NewReader("a"))
+	hash, _ := hashPassword("secret")
+	testServer.MetaOf("/archive_auth").Set(MetaReadAuth, []byte("user:"+hash))
+
+	if rec, _ := downloadArchive(t, "/archive_auth/?archive=tar.gz", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Error("archive served without auth:", rec.Code)
+	}
+	if rec, _ := downloadArchive(t, "/archive_auth/?archive=tar.gz", "user", "bad"); rec.Code != http.StatusUnauthorized {
+		t.Error("archive served with bad password:", rec.Code)
+	}
+	if _, files := downloadArchive(t, "/archive_auth/?archive=tar.gz", "user", "secret"); fileNames(files) != "a.txt" {
+		t.Error("unexpected files:", fileNames(files))
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+const auditPrefix = "/_audit"
+const defaultAuditQueryLimit = 100
+const maxAuditQueryLimit = 1000
+
+// 审计记录的操作类型
+const (
+	AuditUpload    = "upload"
+	AuditRollback  = "rollback"
+	AuditDelete    = "delete"
+	AuditPurge     = "purge"
+	AuditExtract   = "extract"
+	AuditLink      = "link"
+	AuditExpire    = "expire"
+	AuditKeyRotate = "key_rotate"
+	AuditMetaSet   = "meta_set"
+	AuditMetaDel   = "meta_del"
+)
+
+// 审计记录中的认证方式
+const (
+	AuthLegacyForm = "legacy_form" // /upload?k= 明文 key
+	AuthLegacySign = "legacy_sign" // Basic Auth 形式的旧签名
+	AuthSignV2     = "signed"      // FAAS2-HMAC-SHA256
+	AuthCLI        = "cli"         // 命令行操作
+	AuthConfig     = "config"      // 启动时按配置修改
+)
+
+type auditEntry struct {
+	Time time.Time
+	Op   string
+	Path string
+	IP   string
+	// KeyLevel 授权所用 key 设置在哪一级路径
+	KeyLevel string
+	// KeyName 使用的命名 key，为空表示路径的 key
+	KeyName string `json:",omitempty"`
+	Auth    string
+	Size    int64   `json:",omitempty"`
+	Hash    string  `json:",omitempty"`
+	Version string  `json:",omitempty"`
+	MetaKey MetaKey `json:",omitempty"`
+}
+
+// auditLog 只追加的审计日志，每行一条 json
+type auditLog struct {
+	file *rotatingFile
+}
+
+func (a *auditLog) Record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	bin, _ := json.Marshal(entry)
+	if _, err := a.file.Write(append(bin, '\n')); err != nil {
+		log.Println("write audit log err:", err)
+	}
+}
+
+// Query 按路径前缀查询，新的在前，含已轮转的文件
+func (a *auditLog) Query(prefix string, since time.Time, limit int) ([]auditEntry, error) {
+	var result []auditEntry
+	for _, name := range a.file.Files() {
+		entries, err := readAuditFile(name, prefix, since)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+		result = append(result, entries...)
+		if len(result) >= limit {
+			return result[:limit], nil
+		}
+	}
+	return result, nil
+}
+
+func readAuditFile(name, prefix string, since time.Time) ([]auditEntry, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []auditEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var entry auditEntry
+		if json.Unmarshal(s.Bytes(), &entry) != nil { //写了一半的行
+			continue
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+		if prefix == "/" || entry.Path == prefix || strings.HasPrefix(entry.Path, prefix+"/") {
+			result = append(result, entry)
+		}
+	}
+	return result, s.Err()
+}
+
+// newAuditEntry 按通过认证的 key 填写审计记录的公共字段
+func (s *server) newAuditEntry(r *svrkit.Request, p *pathMeta, auth keyAuth, legacyForm bool) auditEntry {
+	return auditEntry{
+		Path:     p.Path(),
+		IP:       s.clientIP(r),
+		KeyLevel: auth.Level,
+		KeyName:  auth.Name,
+		Auth:     authScheme(r, legacyForm),
+	}
+}
+
+// authScheme 请求使用的认证方式
+func authScheme(r *svrkit.Request, legacyForm bool) string {
+	if legacyForm {
+		return AuthLegacyForm
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), tool.SignV2Scheme+" ") {
+		return AuthSignV2
+	}
+	return AuthLegacySign
+}
+
+// auditHandler 查询审计日志，GET /_audit/<prefix>?since=<RFC3339>&limit=100，需用该前缀的 key 或有 meta 权限的命名 key 签名
+func (s *server) auditHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+	if s.audit == nil {
+		rw.WriteCommonResponse(404, "未开启审计日志", nil)
+		return
+	}
+
+	targetMeta := s.MetaOf(strings.TrimPrefix(r.URL.Path, auditPrefix))
+	if _, err := s.authorize(r, targetMeta, ScopeMeta); err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultAuditQueryLimit
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxAuditQueryLimit {
+		limit = maxAuditQueryLimit
+	}
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			rw.WriteCommonResponse(400, "时间格式错误", nil)
+			return
+		}
+		since = t
+	}
+
+	entries, err := s.audit.Query(targetMeta.Path(), since, limit)
+	if err != nil {
+		log.Println("Query audit err:", err)
+		rw.WriteCommonResponse(500, "查询失败", nil)
+		return
+	}
+	rw.WriteCommonResponse(0, "", entries)
+}
+
+// rotatingFile 追加写入的日志文件，超过大小后轮转为 name.1、name.2 ...，maxBackups 为 0 时保留全部备份
+type rotatingFile struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(name string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	n := r.maxBackups
+	if n == 0 {
+		n = r.backupCount() + 1
+	}
+	os.Remove(r.backupName(n))
+	for i := n - 1; i >= 1; i-- {
+		os.Rename(r.backupName(i), r.backupName(i+1))
+	}
+	if err := os.Rename(r.name, r.backupName(1)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", r.name, i)
+}
+
+// backupCount 已有的连续备份数
+func (r *rotatingFile) backupCount() int {
+	n := 0
+	for {
+		if _, err := os.Stat(r.backupName(n + 1)); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// Files 当前文件和备份，新的在前
+func (r *rotatingFile) Files() []string {
+	n := r.maxBackups
+	if n == 0 {
+		n = r.backupCount()
+	}
+	files := []string{r.name}
+	for i := 1; i <= n; i++ {
+		files = append(files, r.backupName(i))
+	}
+	return files
+}
+
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+func TestAuditLog(t *testing.T) {
+	testServer.MetaOf("/audit_test/sub").SetWriteKey("sub key")
+	defer testServer.MetaOf("/audit_test/sub").Destroy()
+	defer testServer.MetaOf("/audit_test/sub/b").Destroy()
+	defer testServer.MetaOf("/audit_test/a").Destroy()
+
+	const ok = `{"Code":0,"Data":null,"Message":""}`
+	if resp := signedRequest("PUT", "/audit_test/a", "hello"); resp != ok {
+		t.Fatal("upload fail:", resp)
+	}
+
+	mockReq, _ := http.NewRequest("PUT", "http://abc.com/audit_test/sub/b", strings.NewReader("world!"))
+	tool.SignRequest("sub key", mockReq)
+	mockReq.RemoteAddr = "10.0.0.8:1234"
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if rec.Body.String() != ok {
+		t.Fatal("signed upload fail:", rec.Body.String())
+	}
+
+	if resp := signedRequest("DELETE", "/audit_test/a", ""); resp != ok {
+		t.Fatal("delete fail:", resp)
+	}
+
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ = http.NewRequest("GET", "http://abc.com/_audit/audit_test?limit=10", nil)
+	tool.SignRequest(peekRootKey, mockReq)
+	rec = httptest.NewRecorder()
+	testServer.ServeHTTP(rec, mockReq)
+
+	var resp struct {
+		Data []auditEntry
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Data) != 3 {
+		t.Fatal("unexpected audit entries:", rec.Body.String())
+	}
+
+	del, signed, legacy := resp.Data[0], resp.Data[1], resp.Data[2]
+	if del.Op != AuditDelete || del.Path != "/audit_test/a" || del.Size != 5 || del.Hash == "" {
+		t.Errorf("unexpected delete entry: %+v", del)
+	}
+	if signed.Op != AuditUpload || signed.KeyLevel != "/audit_test/sub" || signed.Auth != AuthSignV2 ||
+		signed.IP != "10.0.0.8" || signed.Size != 6 {
+		t.Errorf("unexpected signed upload entry: %+v", signed)
+	}
+	if legacy.KeyLevel != "/" || legacy.Auth != AuthLegacySign {
+		t.Errorf("unexpected legacy upload entry: %+v", legacy)
+	}
+
+	mockReq, _ = http.NewRequest("GET", "http://abc.com/_audit/audit_test", nil)
+	tool.SignRequest("sub key", mockReq)
+	rec = httptest.NewRecorder()
+	testServer.ServeHTTP(rec, mockReq)
+	if rec.Body.String() != `{"Code":401,"Data":null,"Message":"认证失败"}` {
+		t.Error("sub key read parent audit log:", rec.Body.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openRotatingFile(name, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &auditLog{file: f}
+	defer f.Close()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		a.Record(auditEntry{Time: start.Add(time.Duration(i) * time.Second), Op: AuditUpload, Path: fmt.Sprint("/r/", i)})
+	}
+
+	entries, err := a.Query("/r", time.Time{}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || len(entries) >= 10 {
+		t.Fatal("backups not limited:", len(entries))
+	}
+	if entries[0].Path != "/r/9" {
+		t.Error("newest entry not first:", entries[0].Path)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Time.After(entries[i-1].Time) {
+			t.Error("entries not in reverse time order")
+		}
+	}
+}
+
+func TestRotatingFile_KeepAll(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openRotatingFile(name, 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &auditLog{file: f}
+	defer f.Close()
+
+	for i := 0; i < 10; i++ {
+		a.Record(auditEntry{Op: AuditUpload, Path: fmt.Sprint("/r/", i)})
+	}
+	if len(f.Files()) < 3 {
+		t.Error("not rotated:", f.Files())
+	}
+	entries, err := a.Query("/r", time.Time{}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Error("audit entries lost on rotation:", len(entries))
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	testServer.accessLog = &buf
+	defer func() { testServer.accessLog = nil }()
+	mockReq, _ := http.NewRequest("POST", "http://abc.com/upload?k=secret&x=1", nil)
+	testServer.writeAccessLog(mockReq, 200, 3, time.Millisecond)
+	if strings.Contains(buf.String(), "secret") || !strings.Contains(buf.String(), `"Status":200`) {
+		t.Error("unexpected access log:", buf.String())
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 服务配置，优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+type Config struct {
+	Listen  string `yaml:"listen"`
+	Storage string `yaml:"storage"`
+	// RootKey 为空时使用存储中的根路径 key，没有则生成
+	RootKey string `yaml:"root_key"`
+	// KeyRotationGrace 轮换 key 后旧 key 仍然有效的时间，root_key 配置变更时也按轮换处理
+	KeyRotationGrace time.Duration `yaml:"key_rotation_grace"`
+	// ForceRootKey 根路径轮换过 key 后仍用 RootKey 覆盖存储中的 key
+	ForceRootKey bool `yaml:"force_root_key"`
+
+	// TrustedProxies 可信代理网段，只采信来自这些地址的代理头，为空时一律用直连地址
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	RealIPHeaders  []string `yaml:"real_ip_headers"`
+
+	TLS        TLSConfig        `yaml:"tls"`
+	Timeouts   TimeoutsConfig   `yaml:"timeouts"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+
+	// MaxUploadSize 单次上传的字节数上限，0 表示不限制
+	MaxUploadSize int64 `yaml:"max_upload_size"`
+	// LogFormat text 或 json
+	LogFormat string `yaml:"log_format"`
+	// AccessLog json 访问日志，"-" 为标准输出，为空时关闭
+	AccessLog string `yaml:"access_log"`
+	// AuditLog 上传、删除和 meta 修改的审计日志文件，为空时关闭
+	AuditLog string `yaml:"audit_log"`
+	// LogMaxSize 访问日志和审计日志文件超过该字节数后轮转，0 表示不轮转
+	LogMaxSize int64 `yaml:"log_max_size"`
+	// LogMaxBackups 轮转后保留的备份数，0 表示全部保留
+	LogMaxBackups int `yaml:"log_max_backups"`
+	// SignWindow 签名时间戳容忍的偏差，对应 tool.TimeSpan
+	SignWindow      time.Duration `yaml:"sign_window"`
+	AllowLegacySign bool          `yaml:"allow_legacy_sign"`
+
+	// MetricsPath Prometheus 指标的路径，默认为空即关闭，开启后会占用该路径，宜用 /_metrics 这类不与内容冲突的路径
+	MetricsPath string `yaml:"metrics_path"`
+	// MetricsAllowIPs 无需 root key 即可读取指标的网段
+	MetricsAllowIPs []string `yaml:"metrics_allow_ips"`
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA 校验客户端证书的 CA 文件，配置后启用 mTLS
+	ClientCA string `yaml:"client_ca"`
+	// ClientAuth optional 有证书就校验，require 必须提供证书
+	ClientAuth string `yaml:"client_auth"`
+	// ReloadInterval 检查证书文件变化的间隔，收到 SIGHUP 时也会重新加载
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type TimeoutsConfig struct {
+	ReadHeader time.Duration `yaml:"read_header"`
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+	// Shutdown 收到 SIGTERM/SIGINT 后等待进行中请求完成的时间
+	Shutdown time.Duration `yaml:"shutdown"`
+}
+
+// EncryptionConfig 静态加密，配置主密钥后新写入的内容和 meta 都加密存储，已有文件用 reencrypt 命令加密
+type EncryptionConfig struct {
+	// Key base64 编码的 32 字节主密钥，和 KeyFile 二选一
+	Key     string `yaml:"key"`
+	KeyFile string `yaml:"key_file"`
+	// OldKeys 轮换前的主密钥，只用于解密，reencrypt 完成后即可移除
+	OldKeys []string `yaml:"old_keys"`
+}
+
+// Enabled 是否配置了主密钥
+func (c *EncryptionConfig) Enabled() bool {
+	return c.Key != "" || c.KeyFile != ""
+}
+
+// masterKeys 解析当前主密钥和旧主密钥
+func (c *EncryptionConfig) masterKeys() (*masterKey, []*masterKey, error) {
+	var current *masterKey
+	var err error
+	if c.KeyFile != "" {
+		current, err = readMasterKeyFile(c.KeyFile)
+	} else {
+		current, err = parseMasterKey(c.Key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var old []*masterKey
+	for _, encoded := range c.OldKeys {
+		k, err := parseMasterKey(encoded)
+		if err != nil {
+			return nil, nil, fmt.Errorf("old key: %w", err)
+		}
+		old = append(old, k)
+	}
+	return current, old, nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:           ":24303",
+		Storage:          "./data",
+		RealIPHeaders:    []string{"X-Forwarded-For", "X-Real-Ip"},
+		LogFormat:        "text",
+		LogMaxSize:       100 << 20,
+		LogMaxBackups:    10,
+		KeyRotationGrace: 24 * time.Hour,
+		TLS: TLSConfig{
+			ClientAuth:     "optional",
+			ReloadInterval: time.Minute,
+		},
+		SignWindow:      10 * time.Second,
+		AllowLegacySign: true,
+		Timeouts: TimeoutsConfig{
+			ReadHeader: 10 * time.Second,
+			Read:       10 * time.Minute, //上传整个请求的时限，SSE 连接到时也会断开重连
+			Idle:       2 * time.Minute,
+			Shutdown:   30 * time.Second,
+		},
+	}
+}
+
+// configEnv 环境变量名，LISTEN、STORAGE、ROOT_KEY 等沿用旧的名字
+var configEnv = map[string]string{
+	"listen":              "LISTEN",
+	"storage":             "STORAGE",
+	"root-key":            "ROOT_KEY",
+	"key-rotation-grace":  "KEY_ROTATION_GRACE",
+	"force-root-key":      "FORCE_ROOT_KEY",
+	"trusted-proxies":     "TRUSTED_PROXIES",
+	"real-ip-headers":     "REAL_IP_HEADERS",
+	"tls-cert":            "TLS_CERT",
+	"tls-key":             "TLS_KEY",
+	"tls-client-ca":       "TLS_CLIENT_CA",
+	"tls-client-auth":     "TLS_CLIENT_AUTH",
+	"tls-reload-interval": "TLS_RELOAD_INTERVAL",
+	"read-header-timeout": "READ_HEADER_TIMEOUT",
+	"read-timeout":        "READ_TIMEOUT",
+	"write-timeout":       "WRITE_TIMEOUT",
+	"idle-timeout":        "IDLE_TIMEOUT",
+	"shutdown-timeout":    "SHUTDOWN_TIMEOUT",
+	"max-upload-size":     "MAX_UPLOAD_SIZE",
+	"log-format":          "LOG_FORMAT",
+	"access-log":          "ACCESS_LOG",
+	"audit-log":           "AUDIT_LOG",
+	"log-max-size":        "LOG_MAX_SIZE",
+	"log-max-backups":     "LOG_MAX_BACKUPS",
+	"sign-window":         "SIGN_WINDOW",
+	"allow-legacy-sign":   "ALLOW_LEGACY_SIGN",
+	"metrics-path":        "METRICS_PATH",
+	"metrics-allow-ips":   "METRICS_ALLOW_IPS",
+	"encryption-key":      "ENCRYPTION_KEY",
+	"encryption-key-file": "ENCRYPTION_KEY_FILE",
+	"encryption-old-keys": "ENCRYPTION_OLD_KEYS",
+}
+
+// configSetter 把字符串形式的值写入配置项，命令行和环境变量共用
+func (c *Config) configSetters() map[string]func(string) error {
+	str := func(p *string) func(string) error {
+		return func(v string) error { *p = v; return nil }
+	}
+	list := func(p *[]string) func(string) error {
+		return func(v string) error {
+			*p = nil
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*p = append(*p, item)
+				}
+			}
+			return nil
+		}
+	}
+	duration := func(p *time.Duration) func(string) error {
+		return func(v string) (err error) { *p, err = time.ParseDuration(v); return }
+	}
+
+	return map[string]func(string) error{
+		"listen":             str(&c.Listen),
+		"storage":            str(&c.Storage),
+		"root-key":           str(&c.RootKey),
+		"key-rotation-grace": duration(&c.KeyRotationGrace),
+		"force-root-key": func(v string) (err error) {
+			c.ForceRootKey, err = strconv.ParseBool(v)
+			return
+		},
+		"trusted-proxies":     list(&c.TrustedProxies),
+		"real-ip-headers":     list(&c.RealIPHeaders),
+		"tls-cert":            str(&c.TLS.Cert),
+		"tls-key":             str(&c.TLS.Key),
+		"tls-client-ca":       str(&c.TLS.ClientCA),
+		"tls-client-auth":     str(&c.TLS.ClientAuth),
+		"tls-reload-interval": duration(&c.TLS.ReloadInterval),
+		"read-header-timeout": duration(&c.Timeouts.ReadHeader),
+		"read-timeout":        duration(&c.Timeouts.Read),
+		"write-timeout":       duration(&c.Timeouts.Write),
+		"idle-timeout":        duration(&c.Timeouts.Idle),
+		"shutdown-timeout":    duration(&c.Timeouts.Shutdown),
+		"max-upload-size": func(v string) (err error) {
+			c.MaxUploadSize, err = strconv.ParseInt(v, 10, 64)
+			return
+		},
+		"log-format": str(&c.LogFormat),
+		"access-log": str(&c.AccessLog),
+		"audit-log":  str(&c.AuditLog),
+		"log-max-size": func(v string) (err error) {
+			c.LogMaxSize, err = strconv.ParseInt(v, 10, 64)
+			return
+		},
+		"log-max-backups": func(v string) (err error) {
+			c.LogMaxBackups, err = strconv.Atoi(v)
+			return
+		},
+		"sign-window": duration(&c.SignWindow),
+		"allow-legacy-sign": func(v string) (err error) {
+			c.AllowLegacySign, err = strconv.ParseBool(v)
+			return
+		},
+		"metrics-path":        str(&c.MetricsPath),
+		"metrics-allow-ips":   list(&c.MetricsAllowIPs),
+		"encryption-key":      str(&c.Encryption.Key),
+		"encryption-key-file": str(&c.Encryption.KeyFile),
+		"encryption-old-keys": list(&c.Encryption.OldKeys),
+	}
+}
+
+// loadConfig 从配置文件、环境变量和命令行参数加载配置，返回剩余的非 flag 参数
+func loadConfig(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("faas", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG"), "yaml config file")
+
+	flagValues := map[string]*string{}
+	for name, env := range configEnv {
+		flagValues[name] = fs.String(name, "", "overrides env "+env)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	c := defaultConfig()
+	if *configFile != "" {
+		bin, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := yaml.Unmarshal(bin, c); err != nil {
+			return nil, nil, fmt.Errorf("parse %s: %w", *configFile, err)
+		}
+	}
+
+	setters := c.configSetters()
+	for name, env := range configEnv {
+		if v := os.Getenv(env); v != "" {
+			if err := setters[name](v); err != nil {
+				return nil, nil, fmt.Errorf("env %s: %w", env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if setter, ok := setters[f.Name]; ok && err == nil {
+			if setErr := setter(*flagValues[f.Name]); setErr != nil {
+				err = fmt.Errorf("flag -%s: %w", f.Name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, fs.Args(), c.Validate()
+}
+
+// Validate 启动时检查配置
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("listen required")
+	}
+	if c.Storage == "" {
+		return errors.New("storage required")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls cert and key must be set together")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		return errors.New("tls client ca requires tls cert")
+	}
+	if c.TLS.ClientAuth != "optional" && c.TLS.ClientAuth != "require" {
+		return fmt.Errorf("unknown tls client auth: %s", c.TLS.ClientAuth)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("unknown log format: %s", c.LogFormat)
+	}
+	if c.SignWindow <= 0 {
+		return errors.New("sign window must be positive")
+	}
+	if c.LogMaxSize < 0 || c.LogMaxBackups < 0 {
+		return errors.New("log rotation settings must not be negative")
+	}
+	if c.KeyRotationGrace < 0 {
+		return errors.New("key rotation grace must not be negative")
+	}
+	if c.MaxUploadSize < 0 {
+		return errors.New("max upload size must not be negative")
+	}
+	for _, d := range []time.Duration{c.Timeouts.ReadHeader, c.Timeouts.Read, c.Timeouts.Write, c.Timeouts.Idle, c.Timeouts.Shutdown} {
+		if d < 0 {
+			return errors.New("timeouts must not be negative")
+		}
+	}
+	if _, err := parseIPEntries(c.TrustedProxies, nil); err != nil {
+		return fmt.Errorf("trusted proxies: %w", err)
+	}
+	if c.MetricsPath != "" && (!strings.HasPrefix(c.MetricsPath, "/") || strings.HasSuffix(c.MetricsPath, "/")) {
+		return fmt.Errorf("bad metrics path: %s", c.MetricsPath)
+	}
+	if _, err := parseIPEntries(c.MetricsAllowIPs, nil); err != nil {
+		return fmt.Errorf("metrics allow ips: %w", err)
+	}
+	if c.Encryption.Key != "" && c.Encryption.KeyFile != "" {
+		return errors.New("encryption key and key file are mutually exclusive")
+	}
+	if c.Encryption.Enabled() {
+		if _, _, err := c.Encryption.masterKeys(); err != nil {
+			return fmt.Errorf("encryption: %w", err)
+		}
+	} else if len(c.Encryption.OldKeys) > 0 {
+		return errors.New("encryption old keys require a key")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "faas.yaml")
+	os.WriteFile(file, []byte(`
+listen: ":8080"
+storage: /srv/faas
+sign_window: 30s
+trusted_proxies: ["10.0.0.0/8"]
+timeouts:
+  read: 1m
+`), 0644)
+
+	t.Setenv("STORAGE", "/env/faas")
+	t.Setenv("MAX_UPLOAD_SIZE", "1024")
+
+	c, args, err := loadConfig([]string{"-config", file, "-max-upload-size", "2048", "migrate-basic-auth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != ":8080" || c.SignWindow != 30*time.Second || c.Timeouts.Read != time.Minute || len(c.TrustedProxies) != 1 {
+		t.Error("file config not loaded:", c)
+	}
+	if c.Storage != "/env/faas" {
+		t.Error("env not override file:", c.Storage)
+	}
+	if c.MaxUploadSize != 2048 {
+		t.Error("flag not override env:", c.MaxUploadSize)
+	}
+	if c.Timeouts.ReadHeader != 10*time.Second {
+		t.Error("default lost:", c.Timeouts.ReadHeader)
+	}
+	if len(args) != 1 || args[0] != "migrate-basic-auth" {
+		t.Error("unexpected args:", args)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, modify := range map[string]func(c *Config){
+		"tls key missing": func(c *Config) { c.TLS.Cert = "cert.pem" },
+		"bad log format":  func(c *Config) { c.LogFormat = "xml" },
+		"bad proxies":     func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/99"} },
+		"zero window":     func(c *Config) { c.SignWindow = 0 },
+	} {
+		c := defaultConfig()
+		modify(c)
+		if c.Validate() == nil {
+			t.Error("invalid config accepted:", name)
+		}
+	}
+
+	if err := defaultConfig().Validate(); err != nil {
+		t.Error("default config invalid:", err)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// 加密文件格式：magic | 主密钥 id | 包装数据密钥的 nonce | 被主密钥加密的数据密钥 | 分块密文...
+// 每个文件使用随机的数据密钥，明文按 encChunkSize 分块，每块单独 AES-GCM 加密，nonce 为块序号，
+// 最后一块（可能为空）的附加数据标记为结尾，防止截断。分块使得 Range 请求只需解密涉及的块，
+// 轮换主密钥时也只需重新包装文件头中的数据密钥
+const (
+	encMagic      = "FAASENC1"
+	encKeyIDSize  = 8
+	encNonceSize  = 12
+	encDataKeyLen = 32
+	encTagSize    = 16
+	encHeaderSize = len(encMagic) + encKeyIDSize + encNonceSize + encDataKeyLen + encTagSize
+	encChunkSize  = 64 << 10
+)
+
+var errEncUnknownKey = errors.New("encrypted with unknown master key")
+var errEncCorrupt = errors.New("encrypted file corrupt")
+
+// masterKey 主密钥，id 写在文件头中用于选择解密用的主密钥
+type masterKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func newMasterKey(key []byte) (*masterKey, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{id: sum[:encKeyIDSize], aead: aead}, nil
+}
+
+// parseMasterKey 解析 base64 编码的主密钥
+func parseMasterKey(encoded string) (*masterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key must be base64: %w", err)
+	}
+	return newMasterKey(key)
+}
+
+func readMasterKeyFile(name string) (*masterKey, error) {
+	bin, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseMasterKey(string(bin))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(i int64) []byte {
+	nonce := make([]byte, encNonceSize)
+	binary.BigEndian.PutUint64(nonce[encNonceSize-8:], uint64(i))
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptedSize 明文大小对应的密文大小
+func encryptedSize(plain int64) int64 {
+	return int64(encHeaderSize) + plain + (plain/encChunkSize+1)*encTagSize
+}
+
+// plainSize 密文大小对应的明文大小
+func plainSize(cipherSize int64) (int64, error) {
+	body := cipherSize - int64(encHeaderSize) - encTagSize
+	if body < 0 {
+		return 0, errEncCorrupt
+	}
+	full, last := body/(encChunkSize+encTagSize), body%(encChunkSize+encTagSize)
+	if last >= encChunkSize {
+		return 0, errEncCorrupt
+	}
+	return full*encChunkSize + last, nil
+}
+
+// encryptedStorage 透明加解密的存储，写入时加密，读取时按文件头判断，未加密的旧文件原样返回，
+// 所以可以先开启加密再用 reencrypt 命令加密已有文件。Stat 和 ReadDir 返回明文大小，需要读文件头
+type encryptedStorage struct {
+	Storage
+	current *masterKey
+	keys    []*masterKey //包括 current 和轮换前的旧主密钥
+}
+
+func newEncryptedStorage(st Storage, current *masterKey, old ...*masterKey) *encryptedStorage {
+	return &encryptedStorage{Storage: st, current: current, keys: append([]*masterKey{current}, old...)}
+}
+
+func (s *encryptedStorage) findKey(id []byte) (*masterKey, bool) {
+	for _, k := range s.keys {
+		if bytes.Equal(k.id, id) {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// readHeader 读取文件头，未加密时返回 nil
+func readHeader(f io.ReadSeeker) ([]byte, error) {
+	header := make([]byte, encHeaderSize)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	n, err := io.ReadFull(f, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && string(header[:len(encMagic)]) != encMagic) {
+		_, err = f.Seek(0, io.SeekStart)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// unwrapKey 从文件头取出数据密钥
+func (s *encryptedStorage) unwrapKey(header []byte) ([]byte, error) {
+	off := len(encMagic)
+	mk, ok := s.findKey(header[off : off+encKeyIDSize])
+	if !ok {
+		return nil, errEncUnknownKey
+	}
+	off += encKeyIDSize
+	dataKey, err := mk.aead.Open(nil, header[off:off+encNonceSize], header[off+encNonceSize:], []byte(encMagic))
+	if err != nil {
+		return nil, errEncCorrupt
+	}
+	return dataKey, nil
+}
+
+// wrapKey 用当前主密钥生成文件头
+func (s *encryptedStorage) wrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, encNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encHeaderSize)
+	header = append(header, encMagic...)
+	header = append(header, s.current.id...)
+	header = append(header, nonce...)
+	return s.current.aead.Seal(header, nonce, dataKey, []byte(encMagic)), nil
+}
+
+func (s *encryptedStorage) Open(name string) (File, error) {
+	f, err := s.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	header, err := readHeader(f)
+	if err == nil && header == nil {
+		return f, nil //未加密的旧文件
+	}
+	var dataKey []byte
+	if err == nil {
+		dataKey, err = s.unwrapKey(header)
+	}
+	var aead cipher.AEAD
+	if err == nil {
+		aead, err = newGCM(dataKey)
+	}
+	var info fs.FileInfo
+	if err == nil {
+		info, err = f.Stat()
+	}
+	var size int64
+	if err == nil {
+		size, err = plainSize(info.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &encryptedFile{f: f, aead: aead, info: &fileInfo{name: info.Name(), size: size, modTime: info.ModTime()}, chunk: -1}, nil
+}
+
+// plainInfo 把文件的大小换成明文大小
+func (s *encryptedStorage) plainInfo(name string, info fs.FileInfo) (fs.FileInfo, error) {
+	if info.IsDir() || info.Size() < encryptedSize(0) {
+		return info, nil
+	}
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (s *encryptedStorage) Stat(name string) (fs.FileInfo, error) {
+	info, err := s.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.plainInfo(name, info)
+}
+
+func (s *encryptedStorage) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := s.Storage.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range entries {
+		if entries[i], err = s.plainInfo(path.Join(name, info.Name()), info); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (s *encryptedStorage) WriteFile(name string, rd io.Reader) error {
+	dataKey := make([]byte, encDataKeyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	header, err := s.wrapKey(dataKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	return s.Storage.WriteFile(name, io.MultiReader(bytes.NewReader(header), &encryptReader{src: rd, aead: aead}))
+}
+
+func (s *encryptedStorage) RenameDir(oldName, newName string) error {
+	return renameDir(s.Storage, oldName, newName)
+}
+
+// Reencrypt 用当前主密钥重新包装文件的数据密钥，未加密的文件整体加密，已是当前主密钥的跳过。
+// 返回是否改写了文件
+func (s *encryptedStorage) Reencrypt(name string) (bool, error) {
+	f, err := s.Storage.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header, err := readHeader(f)
+	if err != nil {
+		return false, err
+	}
+	if header == nil {
+		return true, s.WriteFile(name, f)
+	}
+	if bytes.Equal(header[len(encMagic):len(encMagic)+encKeyIDSize], s.current.id) {
+		return false, nil
+	}
+
+	dataKey, err := s.unwrapKey(header)
+	if err != nil {
+		return false, &fs.PathError{Op: "reencrypt", Path: name, Err: err}
+	}
+	newHeader, err := s.wrapKey(dataKey)
+	if err != nil {
+		return false, err
+	}
+	return true, s.Storage.WriteFile(name, io.MultiReader(bytes.NewReader(newHeader), f)) //分块密文不变
+}
+
+// encryptReader 把明文流转成分块密文
+type encryptReader struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	index int64
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if e.buf == nil {
+			e.buf = make([]byte, encChunkSize)
+		}
+		n, err := fillBuffer(e.src, e.buf)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		final := n < encChunkSize //满块之后还有一个可能为空的结尾块
+		e.out = e.aead.Seal(e.out[:0], chunkNonce(e.index), e.buf[:n], chunkAAD(final))
+		e.index++
+		e.done = final
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// fillBuffer 尽量读满 buf，读到结尾时返回 io.EOF，其他错误原样返回，不会被已读到的数据掩盖
+func fillBuffer(rd io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		nn, err := rd.Read(buf[n:])
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// encryptedFile 按需解密所在的块，支持 Seek
+type encryptedFile struct {
+	f     File
+	aead  cipher.AEAD
+	info  *fileInfo
+	pos   int64
+	chunk int64 //plain 对应的块序号，-1 表示没有
+	plain []byte
+}
+
+func (e *encryptedFile) Read(p []byte) (int, error) {
+	if e.pos >= e.info.size {
+		return 0, io.EOF
+	}
+	idx := e.pos / encChunkSize
+	if idx != e.chunk {
+		if err := e.loadChunk(idx); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.plain[e.pos-idx*encChunkSize:])
+	e.pos += int64(n)
+	return n, nil
+}
+
+func (e *encryptedFile) loadChunk(idx int64) error {
+	lastIdx := e.info.size / encChunkSize
+	length := encChunkSize + encTagSize
+	if idx == lastIdx {
+		length = int(e.info.size-lastIdx*encChunkSize) + encTagSize
+	}
+	if _, err := e.f.Seek(int64(encHeaderSize)+idx*(encChunkSize+encTagSize), io.SeekStart); err != nil {
+		return err
+	}
+	bin := make([]byte, length)
+	if _, err := io.ReadFull(e.f, bin); err != nil {
+		return errEncCorrupt
+	}
+	plain, err := e.aead.Open(bin[:0], chunkNonce(idx), bin, chunkAAD(idx == lastIdx))
+	if err != nil {
+		return errEncCorrupt
+	}
+	e.chunk, e.plain = idx, plain
+	return nil
+}
+
+func (e *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += e.pos
+	case io.SeekEnd:
+		offset += e.info.size
+	default:
+		return 0, errors.New("bad whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	e.pos = offset
+	return offset, nil
+}
+
+func (e *encryptedFile) Stat() (fs.FileInfo, error) { return e.info, nil }
+func (e *encryptedFile) Close() error               { return e.f.Close() }
+
+// reencryptSubDirs 需要加密的存储目录，staging 中的临时内容在执行前清理
+var reencryptSubDirs = []string{metaSubDir, contentSubDir, versionSubDir, uploadsSubDir, expirySubDir, linksSubDir}
+
+// reencryptStorage 命令行 faas reencrypt：把旧主密钥加密的文件换成当前主密钥，未加密的文件加密。
+// 轮换主密钥时把旧主密钥放到 old_keys，执行完成后移除。需在服务停止时执行
+func (s *server) reencryptStorage() (int, error) {
+	enc, ok := s.storage.(*encryptedStorage)
+	if !ok {
+		return 0, errors.New("encryption key not configured")
+	}
+	if err := s.cleanupPartialUploads(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, dir := range reencryptSubDirs {
+		err := walkStorage(enc.Storage, dir, func(name string, info fs.FileInfo) error {
+			ok, err := enc.Reencrypt(name)
+			if ok {
+				changed++
+			}
+			return err
+		})
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
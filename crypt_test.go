@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testMasterKey(t *testing.T) (*masterKey, string) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	mk, err := parseMasterKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mk, encoded
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	mk, _ := testMasterKey(t)
+	testStorage(t, newEncryptedStorage(newMemStorage(), mk))
+	testStorage(t, newEncryptedStorage(newLocalStorage(t.TempDir()), mk))
+}
+
+func TestEncryptedStorage_Chunks(t *testing.T) {
+	mk, _ := testMasterKey(t)
+	inner := newMemStorage()
+	st := newEncryptedStorage(inner, mk)
+
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 100} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		if err := st.WriteFile("content/x", bytes.NewReader(plain)); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := readStorageFile(inner, "content/x")
+		if int64(len(raw)) != encryptedSize(int64(size)) || (size > 16 && bytes.Contains(raw, plain[:16])) {
+			t.Fatal("not encrypted:", size, len(raw))
+		}
+		if info, _ := st.Stat("content/x"); info.Size() != int64(size) {
+			t.Error("plain size not match:", size, info.Size())
+		}
+
+		f, err := st.Open("content/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int{0, size / 2, size - 1, size} {
+			if off < 0 {
+				continue
+			}
+			f.Seek(int64(off), io.SeekStart)
+			if bin, _ := io.ReadAll(f); !bytes.Equal(bin, plain[off:]) {
+				t.Error("seek read not match:", size, off)
+			}
+		}
+		f.Close()
+	}
+
+	//截断或篡改的密文不能读出
+	raw, _ := readStorageFile(inner, "content/x")
+	inner.WriteFile("content/x", bytes.NewReader(raw[:len(raw)-encChunkSize-encTagSize]))
+	if bin, err := readStorageFile(st, "content/x"); err == nil {
+		t.Error("truncated file read:", len(bin))
+	}
+	raw[len(raw)-1] ^= 1
+	inner.WriteFile("content/x", bytes.NewReader(raw))
+	if _, err := readStorageFile(st, "content/x"); err == nil {
+		t.Error("tampered file read")
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	oldKey, _ := testMasterKey(t)
+	newKey, _ := testMasterKey(t)
+	inner := newMemStorage()
+	inner.WriteFile("meta/a/key", strings.NewReader("plain"))
+	newEncryptedStorage(inner, oldKey).WriteFile("content/a", strings.NewReader("old"))
+
+	if _, err := newEncryptedStorage(inner, newKey).Open("content/a"); err == nil {
+		t.Error("opened without old key")
+	}
+
+	saved := testServer.storage
+	defer func() { testServer.storage = saved }()
+	st := newEncryptedStorage(inner, newKey, oldKey)
+	testServer.storage = st
+	if n, err := testServer.reencryptStorage(); err != nil || n != 2 {
+		t.Fatal("reencrypt fail:", n, err)
+	}
+	if n, _ := testServer.reencryptStorage(); n != 0 {
+		t.Error("reencrypted twice:", n)
+	}
+
+	st = newEncryptedStorage(inner, newKey) //旧主密钥已不需要
+	for name, want := range map[string]string{"meta/a/key": "plain", "content/a": "old"} {
+		if bin, err := readStorageFile(st, name); err != nil || string(bin) != want {
+			t.Error("read after reencrypt:", name, string(bin), err)
+		}
+		if raw, _ := readStorageFile(inner, name); bytes.Contains(raw, []byte(want)) {
+			t.Error("not encrypted:", name)
+		}
+	}
+}
+
+func TestEncryptedServer(t *testing.T) {
+	mk, _ := testMasterKey(t)
+	saved := testServer.storage
+	defer func() { testServer.storage = saved }()
+	testServer.storage = newEncryptedStorage(saved, mk)
+	defer testServer.MetaOf("/crypt_test").Destroy()
+
+	body := strings.Repeat("0123456789", 10000)
+	if resp := signedRequest("PUT", "/crypt_test/a.txt", body); !strings.Contains(resp, `"Code":0`) {
+		t.Fatal("upload fail:", resp)
+	}
+	if raw, _ := readStorageFile(saved, testServer.MetaOf("/crypt_test/a.txt").ContentName()); bytes.Contains(raw, []byte("0123456789")) {
+		t.Error("content stored in plaintext")
+	}
+
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/crypt_test/a.txt", nil)
+	mockReq.Header.Set("Range", "bytes=70000-70009")
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, mockReq)
+	if rec.Code != 206 || rec.Body.String() != body[70000:70010] {
+		t.Error("range read fail:", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEncryptionConfig(t *testing.T) {
+	_, encoded := testMasterKey(t)
+	c := defaultConfig()
+	c.Encryption.Key = "short"
+	if c.Validate() == nil {
+		t.Error("bad key accepted")
+	}
+	c.Encryption.Key = encoded
+	c.Encryption.OldKeys = []string{encoded}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+	c.Encryption.KeyFile = "key"
+	if c.Validate() == nil {
+		t.Error("key and key file accepted together")
+	}
+}
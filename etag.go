@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// contentETag 内容的强 ETag，取 sha256
+func contentETag(p *pathMeta) (string, bool) {
+	f, err := p.OpenContent()
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+
+	if v, ok := p.srv.etags.Load(p.ContentName()); ok {
+		if e := v.(etagEntry); e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+			return e.etag, true
+		}
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", false
+	}
+	etag := quoteETag(h.Sum(nil))
+	p.srv.etags.Store(p.ContentName(), etagEntry{info.Size(), info.ModTime(), etag})
+	return etag, true
+}
+
+// rememberETag 写入内容时顺带记录哈希，省掉下次读取时的计算
+func rememberETag(p *pathMeta, etag string) {
+	if info, err := p.StatContent(); err == nil {
+		p.srv.etags.Store(p.ContentName(), etagEntry{info.Size(), info.ModTime(), etag})
+	}
+}
+
+func quoteETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// etagListMatch If-Match / If-None-Match 的列表匹配，只做强比较
+func etagListMatch(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || (etag != "" && v == etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions 检查写请求的 If-Match / If-None-Match，返回 false 表示应返回 412
+func checkPreconditions(p *pathMeta, ifMatch, ifNoneMatch string) bool {
+	if ifMatch == "" && ifNoneMatch == "" {
+		return true
+	}
+
+	etag, exists := contentETag(p)
+	if ifMatch != "" && (!exists || !etagListMatch(ifMatch, etag)) {
+		return false
+	}
+	if ifNoneMatch != "" && exists && etagListMatch(ifNoneMatch, etag) {
+		return false
+	}
+	return true
+}
+
+type refMutex struct {
+	sync.Mutex
+	ref int
+}
+
+// keyedMutex 按路径加锁，保证条件检查和写入之间不被其他写请求插入
+type keyedMutex struct {
+	lock sync.Mutex
+	m    map[string]*refMutex
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{m: make(map[string]*refMutex)}
+}
+
+func (k *keyedMutex) Lock(key string) func() {
+	k.lock.Lock()
+	mu, ok := k.m[key]
+	if !ok {
+		mu = &refMutex{}
+		k.m[key] = mu
+	}
+	mu.ref++
+	k.lock.Unlock()
+
+	mu.Lock()
+	return func() {
+		mu.Unlock()
+		k.lock.Lock()
+		mu.ref--
+		if mu.ref == 0 {
+			delete(k.m, key)
+		}
+		k.lock.Unlock()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/faas/tool"
+)
+
+func TestETagPreconditions(t *testing.T) {
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	defer testServer.MetaOf("/etag_test").Destroy()
+
+	svr := httptest.NewServer(testServer)
+	defer svr.Close()
+	target := svr.URL + "/etag_test"
+
+	if err := tool.Upload(target, peekRootKey, strings.NewReader("v1"), tool.IfNoneMatch("*")); err != nil {
+		t.Fatal("create-only upload failed:", err)
+	}
+	if err := tool.Upload(target, peekRootKey, strings.NewReader("v1 again"), tool.IfNoneMatch("*")); err != tool.ErrPreconditionFailed {
+		t.Error("create-only upload overwrote existing:", err)
+	}
+
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if want, _ := contentETag(testServer.MetaOf("/etag_test")); etag == "" || etag != want {
+		t.Fatal("unexpected etag:", etag)
+	}
+
+	req, _ := http.NewRequest("GET", target, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Error("If-None-Match on GET not 304:", resp.StatusCode)
+	}
+
+	if err := tool.Upload(target, peekRootKey, strings.NewReader("v2"), tool.IfMatch(etag)); err != nil {
+		t.Error("matched upload failed:", err)
+	}
+	if err := tool.Upload(target, peekRootKey, strings.NewReader("v3"), tool.IfMatch(etag)); err != tool.ErrPreconditionFailed {
+		t.Error("stale upload accepted:", err)
+	}
+	if err := tool.Delete(target, peekRootKey, tool.IfMatch(etag)); err != tool.ErrPreconditionFailed {
+		t.Error("stale delete accepted:", err)
+	}
+	if err := tool.Delete(target, peekRootKey); err != nil {
+		t.Error("delete failed:", err)
+	}
+}
+
+func TestUnconditionalWriteLocks(t *testing.T) {
+	defer testServer.MetaOf("/etag_lock").Destroy()
+
+	//模拟进行中的条件写入：持有路径锁时无条件写入必须等待
+	unlock := testServer.pathLocks.Lock("/etag_lock")
+	done := make(chan string)
+	go func() { done <- signedRequest("PUT", "/etag_lock", "b") }()
+	select {
+	case resp := <-done:
+		t.Fatal("unconditional write ignored path lock:", resp)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if resp := <-done; !strings.Contains(resp, `"Code":0`) {
+		t.Error("write fail after unlock:", resp)
+	}
+}
+
+func TestUploadSignV2(t *testing.T) {
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	p := testServer.MetaOf("/etag_sign_v2")
+	defer p.Destroy()
+
+	svr := httptest.NewServer(testServer)
+	defer svr.Close()
+
+	tool.UseSignV2 = true
+	defer func() { tool.UseSignV2 = false }()
+	if err := tool.Upload(svr.URL+p.Path(), peekRootKey, strings.NewReader("v2 signed")); err != nil {
+		t.Fatal("v2 upload failed:", err)
+	}
+	if readContent(p) != "v2 signed" {
+		t.Error("unexpected content:", readContent(p))
+	}
+}
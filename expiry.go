@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horsley/svrkit"
+)
+
+// expirySubDir 过期索引的存储目录
+const expirySubDir = "expiry"
+
+// expiryShards 过期索引按路径哈希分片保存，每次变更只重写一个分片
+const expiryShards = 256
+
+const (
+	expiryMarkerName      = "sharded" //分片索引已建立的标记，不存在时重建索引
+	legacyExpiryIndexName = "index"   //旧版的单文件索引，加载时转换为分片
+)
+
+// expirySweepInterval 后台清理过期内容的间隔
+const expirySweepInterval = time.Minute
+
+var errBadExpiry = errors.New("bad expiry")
+
+// ExpiresAt 本路径自身设置的过期时间，没有设置或格式有误时返回零值
+func (p *pathMeta) ExpiresAt() time.Time {
+	bin, ok := p.Get(MetaExpiresAt, false)
+	if !ok {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(bin)))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Expired 本路径或上级目录是否已过期，过期后读取返回 410，等待后台清理
+func (p *pathMeta) Expired() bool {
+	for dir := p; ; dir = dir.Parent() {
+		if dir.ownExpired() {
+			return true
+		}
+		if dir.Parent() == dir {
+			return false
+		}
+	}
+}
+
+// ownExpired 本路径自身的 expires_at 是否已到，不检查上级目录
+func (p *pathMeta) ownExpired() bool {
+	t := p.ExpiresAt()
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// TTL 路径上生效的 ttl，上传时没有指定过期时间则按它计算，没有设置时返回 0
+func (p *pathMeta) TTL() time.Duration {
+	bin, ok := p.Get(MetaTTL, true)
+	if !ok {
+		return 0
+	}
+	d, _ := parseTTL(bin)
+	return d
+}
+
+func parseTTL(content []byte) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(string(content)))
+	if err != nil || d <= 0 {
+		return 0, errBadExpiry
+	}
+	return d, nil
+}
+
+// uploadExpiry 上传内容的过期时间，优先用 X-Expires-At（RFC3339）或 X-TTL 头，
+// 其次用路径上的 ttl，都没有时返回零值表示不过期
+func uploadExpiry(r *svrkit.Request, p *pathMeta) (time.Time, error) {
+	if v := r.Header.Get("X-Expires-At"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, errBadExpiry
+		}
+		return t, nil
+	}
+	if v := r.Header.Get("X-TTL"); v != "" {
+		d, err := parseTTL([]byte(v))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Now().Add(d), nil
+	}
+	if d := p.TTL(); d > 0 {
+		return time.Now().Add(d), nil
+	}
+	return time.Time{}, nil
+}
+
+// SetExpiry 保存上传内容的过期时间，零值时清除，重新上传的内容不沿用旧的过期时间
+func (p *pathMeta) SetExpiry(t time.Time) error {
+	if t.IsZero() {
+		return p.Del(MetaExpiresAt)
+	}
+	return p.Set(MetaExpiresAt, []byte(t.UTC().Format(time.RFC3339)))
+}
+
+// expiryIndex 设置了 expires_at 的路径和过期时间，按分片持久化到存储，清理时不用遍历整棵树。
+// 索引只是提示，清理前会再读一次 meta 确认
+type expiryIndex struct {
+	srv    *server
+	lock   sync.Mutex
+	shards [expiryShards]map[string]int64
+}
+
+func newExpiryIndex(s *server) *expiryIndex {
+	idx := &expiryIndex{srv: s}
+	for i := range idx.shards {
+		idx.shards[i] = make(map[string]int64)
+	}
+	return idx
+}
+
+func expiryShard(filePath string) int {
+	sum := sha1.Sum([]byte(filePath))
+	return int(sum[0])
+}
+
+func expiryShardName(shard int) string {
+	return path.Join(expirySubDir, fmt.Sprintf("%02x", shard))
+}
+
+// loadExpiryIndex 读取持久化的分片索引，没有时从旧版单文件索引转换，都没有则从 meta 目录重建
+func loadExpiryIndex(s *server) (*expiryIndex, error) {
+	idx := newExpiryIndex(s)
+	_, err := s.storage.Stat(path.Join(expirySubDir, expiryMarkerName))
+	if err == nil {
+		return idx, idx.loadShards()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	entries := make(map[string]int64)
+	bin, err := readStorageFile(s.storage, path.Join(expirySubDir, legacyExpiryIndexName))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(bin, &entries); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		err = walkStorage(s.storage, metaSubDir, func(name string, info fs.FileInfo) error {
+			if MetaKey(info.Name()) != MetaExpiresAt {
+				return nil
+			}
+			p := s.MetaOf(strings.TrimPrefix(path.Dir(name), metaSubDir))
+			if t := p.ExpiresAt(); !t.IsZero() {
+				entries[p.Path()] = t.Unix()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	dirty := make(map[int]bool)
+	for filePath, ts := range entries {
+		shard := expiryShard(filePath)
+		idx.shards[shard][filePath] = ts
+		dirty[shard] = true
+	}
+	for shard := range dirty {
+		if err := idx.saveShard(shard); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.storage.WriteFile(path.Join(expirySubDir, expiryMarkerName), strings.NewReader("")); err != nil {
+		return nil, err
+	}
+	s.storage.Remove(path.Join(expirySubDir, legacyExpiryIndexName))
+	return idx, nil
+}
+
+// loadShards 读取已有的分片，空分片不保存
+func (e *expiryIndex) loadShards() error {
+	entries, err := e.srv.storage.ReadDir(expirySubDir)
+	if err != nil {
+		return err
+	}
+	for _, info := range entries {
+		shard, err := strconv.ParseUint(info.Name(), 16, 8)
+		if err != nil || len(info.Name()) != 2 {
+			continue
+		}
+		bin, err := readStorageFile(e.srv.storage, expiryShardName(int(shard)))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(bin, &e.shards[shard]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *expiryIndex) saveShard(shard int) error {
+	if len(e.shards[shard]) == 0 {
+		err := e.srv.storage.Remove(expiryShardName(shard))
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return err
+	}
+	bin, _ := json.Marshal(e.shards[shard])
+	return e.srv.storage.WriteFile(expiryShardName(shard), strings.NewReader(string(bin)))
+}
+
+// Track 记录路径的过期时间，零值表示不再过期，只重写路径所在的分片
+func (e *expiryIndex) Track(filePath string, t time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	shard := expiryShard(filePath)
+	if t.IsZero() {
+		if _, ok := e.shards[shard][filePath]; !ok {
+			return
+		}
+		delete(e.shards[shard], filePath)
+	} else {
+		e.shards[shard][filePath] = t.Unix()
+	}
+	if err := e.saveShard(shard); err != nil {
+		log.Println("save expiry index err:", err)
+	}
+}
+
+// Due 到期的路径
+func (e *expiryIndex) Due(now time.Time) []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var result []string
+	for _, entries := range e.shards {
+		for filePath, ts := range entries {
+			if ts <= now.Unix() {
+				result = append(result, filePath)
+			}
+		}
+	}
+	return result
+}
+
+// Expired 索引中记录的路径自身是否已到期，不读存储，用于列表等批量判断
+func (e *expiryIndex) Expired(filePath string, now time.Time) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	ts, ok := e.shards[expiryShard(filePath)][filePath]
+	return ok && ts <= now.Unix()
+}
+
+// Sweep 删除到期的内容及其 meta 和历史版本，到期的是目录时删除整个目录，返回删除的路径数。
+// 写入都持有路径锁，这里在同一把锁下重新读取 expires_at，不会删掉刚重新上传的内容
+func (e *expiryIndex) Sweep(now time.Time) int {
+	removed := 0
+	for _, filePath := range e.Due(now) {
+		p := e.srv.MetaOf(filePath)
+		unlock := e.srv.pathLocks.Lock(p.Path())
+		t := p.ExpiresAt()
+		switch {
+		case t.IsZero() || p.Parent() == p: //已删除或已清除过期时间，根目录不清理
+			e.Track(filePath, time.Time{})
+		case t.After(now): //重新上传后延期了
+			e.Track(filePath, t)
+		default:
+			if err := p.destroyTree(); err != nil {
+				log.Println("Destroy expired err:", err, filePath)
+				break
+			}
+			e.Track(filePath, time.Time{})
+			e.srv.audit.Record(auditEntry{Op: AuditExpire, Path: filePath})
+			removed++
+		}
+		unlock()
+	}
+	return removed
+}
+
+// Run 定期清理，不会返回
+func (e *expiryIndex) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		e.Sweep(time.Now())
+	}
+}
+
+// destroyTree 同 Destroy，目录时连同其下所有文件一起删除
+func (p *pathMeta) destroyTree() error {
+	if !p.IsDir() {
+		return p.Destroy()
+	}
+	err := walkStorage(p.srv.storage, p.ContentName(), func(name string, info fs.FileInfo) error {
+		fileMeta := p.srv.MetaOf(strings.TrimPrefix(name, contentSubDir))
+		unlock := p.srv.pathLocks.Lock(fileMeta.Path())
+		defer unlock()
+		return fileMeta.Destroy()
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{p.metaName, p.versionDir(), p.ContentName()} {
+		if err := p.srv.storage.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	p.srv.changes.Publish(changeEvent{Path: p.Path(), Op: ChangeDelete})
+	return nil
+}
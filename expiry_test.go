@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+func uploadWithHeader(t *testing.T, target, body string, header map[string]string) string {
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ := http.NewRequest("PUT", "http://abc.com"+target, strings.NewReader(body))
+	for k, v := range header {
+		mockReq.Header.Set(k, v)
+	}
+	if err := tool.SignRequest(peekRootKey, mockReq); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	return rec.Body.String()
+}
+
+func TestExpiry(t *testing.T) {
+	p := testServer.MetaOf("/expiry_test/a.txt")
+	defer testServer.MetaOf("/expiry_test").Destroy()
+
+	if resp := uploadWithHeader(t, "/expiry_test/a.txt", "tmp", map[string]string{"X-TTL": "1h"}); resp != `{"Code":0,"Data":null,"Message":""}` {
+		t.Fatal("upload fail:", resp)
+	}
+	if d := time.Until(p.ExpiresAt()); d < 59*time.Minute || d > time.Hour {
+		t.Error("unexpected expiry:", p.ExpiresAt())
+	}
+	if resp := uploadWithHeader(t, "/expiry_test/a.txt", "tmp", map[string]string{"X-TTL": "soon"}); resp != `{"Code":400,"Data":null,"Message":"过期时间格式错误"}` {
+		t.Error("bad ttl accepted:", resp)
+	}
+
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	uploadWithHeader(t, "/expiry_test/a.txt", "tmp", map[string]string{"X-Expires-At": past})
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/expiry_test/a.txt", nil)
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if rec.Code != http.StatusGone {
+		t.Error("expired content served:", rec.Code)
+	}
+
+	if n := testServer.expiries.Sweep(time.Now()); n != 1 {
+		t.Error("unexpected sweep count:", n)
+	}
+	if _, err := p.StatContent(); err == nil {
+		t.Error("expired content not removed")
+	}
+	if due := testServer.expiries.Due(time.Now().Add(time.Hour)); len(due) != 0 {
+		t.Error("index not cleaned:", due)
+	}
+}
+
+func TestExpiry_TTLMeta(t *testing.T) {
+	p := testServer.MetaOf("/expiry_ttl/a.txt")
+	defer testServer.MetaOf("/expiry_ttl").Destroy()
+	testServer.MetaOf("/expiry_ttl").Set(MetaTTL, []byte("24h"))
+
+	uploadWithHeader(t, "/expiry_ttl/a.txt", "tmp", nil)
+	if d := time.Until(p.ExpiresAt()); d < 23*time.Hour || d > 24*time.Hour {
+		t.Error("ttl meta not applied:", p.ExpiresAt())
+	}
+
+	//重新上传时没有 ttl 则不再过期
+	testServer.MetaOf("/expiry_ttl").Del(MetaTTL)
+	uploadWithHeader(t, "/expiry_ttl/a.txt", "keep", nil)
+	if !p.ExpiresAt().IsZero() {
+		t.Error("old expiry kept:", p.ExpiresAt())
+	}
+
+	//延期后到期的旧索引不会删除内容
+	p.SetExpiry(time.Now().Add(-time.Minute))
+	p.Set(MetaExpiresAt, []byte(time.Now().Add(time.Hour).Format(time.RFC3339)))
+	if n := testServer.expiries.Sweep(time.Now()); n != 0 || readContent(p) != "keep" {
+		t.Error("extended content removed")
+	}
+}
+
+func TestExpiry_Dir(t *testing.T) {
+	testServer.MetaOf("/expiry_dir/a/b.txt").SaveContent(strings.NewReader("b"))
+	testServer.MetaOf("/expiry_dir/c.txt").SaveContent(strings.NewReader("c"))
+	testServer.MetaOf("/expiry_dir").SetExpiry(time.Now().Add(-time.Minute))
+
+	//清理前目录下的文件也不能再读取
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/expiry_dir/a/b.txt", nil)
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if rec.Code != http.StatusGone {
+		t.Error("file under expired dir served:", rec.Code)
+	}
+
+	if n := testServer.expiries.Sweep(time.Now()); n != 1 {
+		t.Error("unexpected sweep count:", n)
+	}
+	if _, err := testServer.storage.Stat(testServer.MetaOf("/expiry_dir").ContentName()); err == nil {
+		t.Error("expired dir not removed")
+	}
+}
+
+func TestLoadExpiryIndex(t *testing.T) {
+	p := testServer.MetaOf("/expiry_load")
+	defer p.Destroy()
+	p.SaveContent(strings.NewReader("x"))
+	p.SetExpiry(time.Now().Add(-time.Minute))
+	defer testServer.expiries.Track(p.Path(), time.Time{})
+
+	expectDue := func(msg string) {
+		t.Helper()
+		idx, err := loadExpiryIndex(testServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		due := idx.Due(time.Now())
+		for _, filePath := range due {
+			if filePath == p.Path() {
+				return
+			}
+		}
+		t.Error(msg, due)
+	}
+
+	//没有分片标记时从 meta 重建
+	testServer.storage.Remove(path.Join(expirySubDir, expiryMarkerName))
+	expectDue("index not rebuilt:")
+
+	//已有分片时直接读取
+	testServer.expiries.Track(p.Path(), p.ExpiresAt())
+	expectDue("shard not loaded:")
+
+	//旧版单文件索引转换为分片
+	testServer.storage.RemoveAll(expirySubDir)
+	legacy := fmt.Sprintf(`{%q: %d}`, p.Path(), p.ExpiresAt().Unix())
+	testServer.storage.WriteFile(path.Join(expirySubDir, legacyExpiryIndexName), strings.NewReader(legacy))
+	expectDue("legacy index not migrated:")
+	if _, err := testServer.storage.Stat(path.Join(expirySubDir, legacyExpiryIndexName)); err == nil {
+		t.Error("legacy index not removed")
+	}
+	expectDue("migrated shard not loaded:")
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+// maxExtractFiles 单个压缩包最多包含的文件数
+const maxExtractFiles = 100000
+
+var (
+	errArchiveFormat   = errors.New("unsupported archive format")
+	errArchiveEntry    = errors.New("bad archive entry")
+	errArchiveEmpty    = errors.New("empty archive")
+	errArchiveTooLarge = errors.New("archive too large")
+	errSwapUnsupported = errors.New("storage cannot swap directories atomically")
+)
+
+type extractResult struct {
+	Files int
+	Bytes int64
+}
+
+// archiveWalker 依次回调压缩包中的普通文件，目录条目跳过，链接等其他类型返回 errArchiveEntry
+type archiveWalker func(fn func(name string, rd io.Reader) error) error
+
+// fileReaderAt 让存储后端的文件支持 ReadAt，zip 需要随机读取
+type fileReaderAt struct {
+	lock sync.Mutex
+	f    File
+}
+
+func (r *fileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err := r.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// openArchive 按内容识别 tar、tar.gz 和 zip
+func openArchive(f io.ReaderAt, size int64) (archiveWalker, error) {
+	head := make([]byte, 4)
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")) {
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			return nil, errArchiveFormat
+		}
+		return func(fn func(name string, rd io.Reader) error) error {
+			for _, zf := range zr.File {
+				if zf.FileInfo().IsDir() {
+					continue
+				}
+				if !zf.Mode().IsRegular() {
+					return errArchiveEntry
+				}
+				rd, err := zf.Open()
+				if err != nil {
+					return err
+				}
+				err = fn(zf.Name, rd)
+				rd.Close()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	}
+
+	gzipped := bytes.HasPrefix(head, []byte{0x1f, 0x8b})
+	return func(fn func(name string, rd io.Reader) error) error {
+		var rd io.Reader = io.NewSectionReader(f, 0, size)
+		if gzipped {
+			gz, err := gzip.NewReader(bufio.NewReader(rd))
+			if err != nil {
+				return errArchiveFormat
+			}
+			defer gz.Close()
+			rd = gz
+		}
+		tr := tar.NewReader(rd)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errArchiveFormat
+			}
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				continue
+			case tar.TypeReg, tar.TypeRegA:
+			default:
+				return errArchiveEntry
+			}
+			if err := fn(hdr.Name, tr); err != nil {
+				return err
+			}
+		}
+	}, nil
+}
+
+// archiveEntryPath 条目在目录下的完整路径，和 MetaOf 一样拒绝跳出目录
+func archiveEntryPath(dirPath, name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	rel := path.Clean("/" + name)
+	if rel == "/" {
+		return "", false
+	}
+	full := path.Join(dirPath, rel)
+	if _, ok := metaNameOf(full); !ok {
+		return "", false
+	}
+	return full, true
+}
+
+// limitedReader 超过 n 字节时返回 errArchiveTooLarge，防止压缩炸弹
+type limitedReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return l.rd.Read(p)
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.rd.Read(p)
+	if int64(n) > l.n {
+		return int(l.n), errArchiveTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+func minLimit(a, b int64) int64 {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// extractHandler 把请求体中的压缩包解到目录，?extract=1 整体替换目录，?extract=merge 合并到已有内容。
+// 替换时先解到 staging 再原子换入（见 swapDir），存储后端不支持时拒绝替换；合并时逐个文件保存，
+// 条目路径和类型会先全部检查一遍，但保存中途出错时已保存的文件不会回退
+func (s *server) extractHandler(rw *svrkit.ResponseWriter, r *svrkit.Request, dirMeta *pathMeta, body io.Reader, entry auditEntry, expiresAt time.Time) {
+	if info, err := dirMeta.StatContent(); err == nil && !info.IsDir() {
+		rw.WriteCommonResponse(403, "非法目标", nil)
+		return
+	}
+	merge := r.URL.Query().Get("extract") == "merge"
+	if !merge && dirMeta.Parent() == dirMeta {
+		rw.WriteCommonResponse(403, "不能替换根目录", nil)
+		return
+	}
+	if _, ok := asDirSwapper(s.storage); !merge && !ok {
+		rw.WriteCommonResponse(501, "存储后端不支持整体替换，请用 extract=merge", nil)
+		return
+	}
+
+	//压缩包先暂存到存储的 staging 中，和其他内容一样经过存储后端（包括静态加密）
+	spoolName := path.Join(s.stagingDir, uuid.NewString())
+	defer s.storage.Remove(spoolName)
+
+	hash := sha256.New()
+	var size byteCounter
+	err := s.storage.WriteFile(spoolName, io.TeeReader(body, io.MultiWriter(hash, &size)))
+	var bodyTooLarge *http.MaxBytesError
+	if errors.As(err, &bodyTooLarge) {
+		rw.WriteCommonResponse(413, "文件过大", nil)
+		return
+	}
+	if errors.Is(err, tool.ErrContentHashMismatch) {
+		rw.WriteCommonResponse(400, "内容校验失败", nil)
+		return
+	}
+	if err != nil {
+		rw.WriteCommonResponse(400, "读取内容失败", nil)
+		return
+	}
+
+	spool, err := s.storage.Open(spoolName)
+	if err != nil {
+		log.Println("Open extract spool err:", err, dirMeta.Path())
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+	defer spool.Close()
+
+	walk, err := openArchive(&fileReaderAt{f: spool}, int64(size))
+	if err == nil {
+		err = checkArchive(walk, dirMeta.Path())
+	}
+
+	unlock := s.pathLocks.Lock(dirMeta.Path())
+	defer unlock()
+
+	var result *extractResult
+	if err == nil && merge {
+		result, err = extractMerge(walk, dirMeta, expiresAt)
+	} else if err == nil {
+		result, err = extractReplace(walk, dirMeta, expiresAt)
+	}
+
+	var tooLarge *errUploadLimit
+	switch {
+	case errors.Is(err, errArchiveFormat):
+		rw.WriteCommonResponse(400, "不支持的压缩格式", nil)
+		return
+	case errors.Is(err, errArchiveEntry):
+		rw.WriteCommonResponse(400, "压缩包包含非法条目", nil)
+		return
+	case errors.Is(err, errArchiveEmpty):
+		rw.WriteCommonResponse(400, "压缩包为空", nil)
+		return
+	case errors.Is(err, errQuotaExceeded), errors.As(err, &tooLarge) && tooLarge.byQuota:
+		rw.WriteCommonResponse(507, "超出配额", nil)
+		return
+	case errors.Is(err, errArchiveTooLarge), tooLarge != nil:
+		rw.WriteCommonResponse(413, "文件过大", nil)
+		return
+	case err != nil:
+		log.Println("Extract err:", err, dirMeta.Path())
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+
+	entry.Op, entry.Size, entry.Hash = AuditExtract, result.Bytes, hex.EncodeToString(hash.Sum(nil))
+	s.audit.Record(entry)
+	rw.WriteCommonResponse(0, "", result)
+}
+
+// checkArchive 保存前先检查全部条目的路径和类型
+func checkArchive(walk archiveWalker, dirPath string) error {
+	files := 0
+	err := walk(func(name string, rd io.Reader) error {
+		if _, ok := archiveEntryPath(dirPath, name); !ok {
+			return errArchiveEntry
+		}
+		files++
+		if files > maxExtractFiles {
+			return errArchiveTooLarge
+		}
+		return nil
+	})
+	if err == nil && files == 0 {
+		return errArchiveEmpty
+	}
+	return err
+}
+
+// errUploadLimit 单个文件超过 max_size 或配额
+type errUploadLimit struct {
+	byQuota bool
+}
+
+func (e *errUploadLimit) Error() string {
+	return "upload limit exceeded"
+}
+
+// extractMerge 逐个文件保存，和单独上传一样重新设置过期时间
+func extractMerge(walk archiveWalker, dirMeta *pathMeta, expiresAt time.Time) (*extractResult, error) {
+	result := &extractResult{}
+	err := walk(func(name string, rd io.Reader) error {
+		full, _ := archiveEntryPath(dirMeta.Path(), name)
+		fileMeta := dirMeta.srv.MetaOf(full)
+		limit, byQuota, err := uploadLimit(fileMeta)
+		if err != nil {
+			return err
+		}
+		counted := &limitedReader{rd: rd, n: limit}
+		if err := fileMeta.SaveContent(counted); err != nil {
+			if errors.Is(err, errArchiveTooLarge) {
+				return &errUploadLimit{byQuota: byQuota}
+			}
+			return err
+		}
+		if err := fileMeta.SetExpiry(expiresAt); err != nil {
+			log.Println("SetExpiry err:", err, full)
+		}
+		result.Files++
+		if info, err := fileMeta.StatContent(); err == nil {
+			result.Bytes += info.Size()
+		}
+		return nil
+	})
+	return result, err
+}
+
+// extractReplace 换入新目录后，压缩包中的文件重新设置过期时间，被删掉的文件清理各自的 meta
+func extractReplace(walk archiveWalker, dirMeta *pathMeta, expiresAt time.Time) (*extractResult, error) {
+	dirPath := dirMeta.Path()
+	stagingDir := path.Join(dirMeta.srv.stagingDir, uuid.NewString())
+	defer dirMeta.srv.storage.RemoveAll(stagingDir)
+
+	totalLimit := int64(-1)
+	if dirMeta.srv.conf.MaxUploadSize > 0 {
+		totalLimit = dirMeta.srv.conf.MaxUploadSize
+	}
+
+	result := &extractResult{}
+	etags := make(map[string]string)
+	err := walk(func(name string, rd io.Reader) error {
+		full, _ := archiveEntryPath(dirPath, name)
+		fileLimit := int64(-1)
+		if n := dirMeta.srv.MetaOf(full).MaxSize(); n > 0 {
+			fileLimit = n
+		}
+		if totalLimit >= 0 {
+			fileLimit = minLimit(fileLimit, totalLimit-result.Bytes)
+		}
+
+		hash := sha256.New()
+		var size byteCounter
+		counted := &limitedReader{rd: io.TeeReader(rd, io.MultiWriter(hash, &size)), n: fileLimit}
+		err := dirMeta.srv.storage.WriteFile(path.Join(stagingDir, strings.TrimPrefix(full, dirPath+"/")), counted)
+		if errors.Is(err, errArchiveTooLarge) {
+			return err
+		}
+		if err != nil { //同一路径既是文件又是目录
+			return errArchiveEntry
+		}
+		result.Files++
+		result.Bytes += int64(size)
+		etags[full] = quoteETag(hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := dirMeta.srv.usage.Get(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	for prefix, q := range dirMeta.Quotas() {
+		used, err := dirMeta.srv.usage.Get(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if q.Bytes > 0 && used.Bytes-old.Bytes+result.Bytes > q.Bytes {
+			return nil, errQuotaExceeded
+		}
+		if q.Files > 0 && used.Files-old.Files+int64(result.Files) > q.Files {
+			return nil, errQuotaExceeded
+		}
+	}
+
+	//被替换掉的文件按各自的 versions 设置归档，并记下用于通知删除
+	removed := make(map[string]int) //路径 -> 保留的版本数
+	walkStorage(dirMeta.srv.storage, dirMeta.ContentName(), func(name string, info fs.FileInfo) error {
+		filePath := "/" + strings.TrimPrefix(name, contentSubDir+"/")
+		fileMeta := dirMeta.srv.MetaOf(filePath)
+		keep := fileMeta.KeepVersions()
+		if keep > 0 {
+			if err := fileMeta.archive(keep); err != nil {
+				log.Println("Archive before extract err:", err, filePath)
+			}
+		}
+		if _, ok := etags[filePath]; !ok {
+			removed[filePath] = keep
+		}
+		return nil
+	})
+
+	if err := swapDir(dirMeta.srv.storage, stagingDir, dirMeta.ContentName()); err != nil {
+		return nil, err
+	}
+	dirMeta.srv.usage.Invalidate(dirPath)
+	dirMeta.srv.metrics.bytesWritten.Add(float64(result.Bytes))
+
+	for filePath, keep := range removed {
+		if err := dirMeta.srv.MetaOf(filePath).dropFileMeta(keep); err != nil {
+			log.Println("Drop meta after extract err:", err, filePath)
+		}
+		dirMeta.srv.changes.Publish(changeEvent{Path: filePath, Op: ChangeDelete})
+	}
+	for filePath, etag := range etags {
+		if err := dirMeta.srv.MetaOf(filePath).SetExpiry(expiresAt); err != nil {
+			log.Println("SetExpiry err:", err, filePath)
+		}
+		dirMeta.srv.changes.Publish(changeEvent{Path: filePath, Op: ChangeUpdate, ETag: etag})
+	}
+	return result, nil
+}
+
+// swapDir 用 newDir 替换 target，读者只会看到旧目录或新目录。target 不存在时整体移动过去，
+// 存在时和 newDir 原子交换，换出来的旧目录随后删除；后端须支持 dirSwapper
+func swapDir(st Storage, newDir, target string) error {
+	sw, ok := asDirSwapper(st)
+	if !ok {
+		return errSwapUnsupported
+	}
+	if _, err := st.Stat(target); errors.Is(err, fs.ErrNotExist) {
+		return renameDir(st, newDir, target)
+	}
+	if err := sw.SwapDir(newDir, target); err != nil {
+		return err
+	}
+	st.RemoveAll(newDir)
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+type archiveFile struct {
+	Name, Body string
+	Type       byte
+}
+
+func makeTarGz(files []archiveFile) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.Name, Mode: 0644, Size: int64(len(f.Body)), Typeflag: f.Type}
+		if f.Type == tar.TypeSymlink {
+			hdr.Size, hdr.Linkname = 0, f.Body
+		}
+		tw.WriteHeader(hdr)
+		if f.Type != tar.TypeSymlink {
+			tw.Write([]byte(f.Body))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.String()
+}
+
+func makeZip(files []archiveFile) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, _ := zw.Create(f.Name)
+		w.Write([]byte(f.Body))
+	}
+	zw.Close()
+	return buf.String()
+}
+
+func TestExtract(t *testing.T) {
+	defer testServer.MetaOf("/extract_test").Destroy()
+	testServer.MetaOf("/extract_test/old.txt").SaveContent(strings.NewReader("old"))
+
+	archive := makeTarGz([]archiveFile{
+		{Name: "index.html", Body: "<html>", Type: tar.TypeReg},
+		{Name: "assets/", Type: tar.TypeDir},
+		{Name: "assets/app.js", Body: "js", Type: tar.TypeReg},
+	})
+	if resp := signedRequest("PUT", "/extract_test/?extract=1", archive); resp != `{"Code":0,"Data":{"Files":2,"Bytes":8},"Message":""}` {
+		t.Fatal("extract fail:", resp)
+	}
+	if got := readContent(testServer.MetaOf("/extract_test/assets/app.js")); got != "js" {
+		t.Error("unexpected content:", got)
+	}
+	if _, err := testServer.MetaOf("/extract_test/old.txt").StatContent(); err == nil {
+		t.Error("old file kept after replace")
+	}
+
+	archive = makeZip([]archiveFile{{Name: "robots.txt", Body: "robots"}})
+	if resp := signedRequest("PUT", "/extract_test/?extract=merge", archive); resp != `{"Code":0,"Data":{"Files":1,"Bytes":6},"Message":""}` {
+		t.Fatal("merge fail:", resp)
+	}
+	if readContent(testServer.MetaOf("/extract_test/robots.txt")) != "robots" || readContent(testServer.MetaOf("/extract_test/index.html")) != "<html>" {
+		t.Error("merge lost files")
+	}
+}
+
+func TestExtract_NamedKeyScope(t *testing.T) {
+	defer testServer.MetaOf("/extract_scope").Destroy()
+	testServer.MetaOf("/extract_scope/keep.txt").SaveContent(strings.NewReader("keep"))
+	testServer.MetaOf("/extract_scope").Set(MetaKeys, []byte(`{
+		"ci": {"Key": "ci-secret", "Scopes": ["upload"]},
+		"deploy": {"Key": "deploy-secret", "Scopes": ["upload", "delete"]}
+	}`))
+
+	archive := makeZip([]archiveFile{{Name: "new.txt", Body: "new"}})
+	if code := namedKeyRequest(t, "PUT", "/extract_scope/?extract=1", "ci", "ci-secret", archive); code != 403 {
+		t.Error("upload-only key replaced directory:", code)
+	}
+	if readContent(testServer.MetaOf("/extract_scope/keep.txt")) != "keep" {
+		t.Fatal("file deleted by upload-only key")
+	}
+	if code := namedKeyRequest(t, "PUT", "/extract_scope/?extract=merge", "ci", "ci-secret", archive); code != 0 {
+		t.Error("upload-only key merge fail:", code)
+	}
+	if code := namedKeyRequest(t, "PUT", "/extract_scope/?extract=1", "deploy", "deploy-secret", archive); code != 0 {
+		t.Error("replace with delete scope fail:", code)
+	}
+}
+
+func TestExtract_Reject(t *testing.T) {
+	defer testServer.MetaOf("/extract_reject").Destroy()
+	testServer.MetaOf("/extract_reject/keep.txt").SaveContent(strings.NewReader("keep"))
+
+	cases := []struct {
+		name, archive, resp string
+	}{
+		{"traversal", makeTarGz([]archiveFile{{Name: "../escape.txt", Body: "x", Type: tar.TypeReg}}), `{"Code":400,"Data":null,"Message":"压缩包包含非法条目"}`},
+		{"zip traversal", makeZip([]archiveFile{{Name: "a/../../escape.txt", Body: "x"}}), `{"Code":400,"Data":null,"Message":"压缩包包含非法条目"}`},
+		{"symlink", makeTarGz([]archiveFile{{Name: "link", Body: "/etc/passwd", Type: tar.TypeSymlink}}), `{"Code":400,"Data":null,"Message":"压缩包包含非法条目"}`},
+		{"empty", makeTarGz(nil), `{"Code":400,"Data":null,"Message":"压缩包为空"}`},
+		{"format", "not an archive", `{"Code":400,"Data":null,"Message":"不支持的压缩格式"}`},
+	}
+	for _, c := range cases {
+		if resp := signedRequest("PUT", "/extract_reject/?extract=1", c.archive); resp != c.resp {
+			t.Error(c.name, "unexpected response:", resp)
+		}
+	}
+	if readContent(testServer.MetaOf("/extract_reject/keep.txt")) != "keep" {
+		t.Error("rejected archive modified directory")
+	}
+	if _, err := testServer.MetaOf("/escape.txt").StatContent(); err == nil {
+		testServer.MetaOf("/escape.txt").Destroy()
+		t.Error("traversal entry written outside directory")
+	}
+}
+
+func TestExtract_Limits(t *testing.T) {
+	defer testServer.MetaOf("/extract_limit").Destroy()
+	testServer.MetaOf("/extract_limit").Set(MetaMaxSize, []byte("5"))
+	testServer.MetaOf("/extract_limit/keep.txt").SaveContent(strings.NewReader("keep"))
+
+	archive := makeTarGz([]archiveFile{{Name: "big.txt", Body: "123456", Type: tar.TypeReg}})
+	if resp := signedRequest("PUT", "/extract_limit/?extract=1", archive); resp != `{"Code":413,"Data":null,"Message":"文件过大"}` {
+		t.Error("oversize entry accepted:", resp)
+	}
+	if resp := signedRequest("PUT", "/extract_limit/?extract=merge", archive); resp != `{"Code":413,"Data":null,"Message":"文件过大"}` {
+		t.Error("oversize entry merged:", resp)
+	}
+
+	testServer.MetaOf("/extract_limit").Del(MetaMaxSize)
+	testServer.MetaOf("/extract_limit").Set(MetaQuota, []byte(`{"files": 2}`))
+	testServer.usage.Invalidate("/extract_limit")
+	archive = makeTarGz([]archiveFile{
+		{Name: "a", Body: "a", Type: tar.TypeReg},
+		{Name: "b", Body: "b", Type: tar.TypeReg},
+		{Name: "c", Body: "c", Type: tar.TypeReg},
+	})
+	if resp := signedRequest("PUT", "/extract_limit/?extract=1", archive); resp != `{"Code":507,"Data":null,"Message":"超出配额"}` {
+		t.Error("quota exceeded:", resp)
+	}
+	if readContent(testServer.MetaOf("/extract_limit/keep.txt")) != "keep" {
+		t.Error("rejected archive modified directory")
+	}
+}
+
+func TestExtract_Expiry(t *testing.T) {
+	defer testServer.MetaOf("/extract_expiry").Destroy()
+	old := testServer.MetaOf("/extract_expiry/old.txt")
+	old.SaveContent(strings.NewReader("old"))
+	old.SetExpiry(time.Now().Add(-time.Minute))
+	gone := testServer.MetaOf("/extract_expiry/gone.txt")
+	gone.SaveContent(strings.NewReader("gone"))
+	gone.Set(MetaContentType, []byte("text/x-gone"))
+	gone.SetExpiry(time.Now().Add(time.Hour))
+
+	extract := func(query string, header http.Header, archive string) string {
+		peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+		mockReq, _ := http.NewRequest("PUT", "http://abc.com/extract_expiry/?extract="+query, strings.NewReader(archive))
+		for k, v := range header {
+			mockReq.Header[k] = v
+		}
+		tool.SignUpload(peekRootKey, mockReq)
+		rec := httptest.NewRecorder()
+		testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+		return rec.Body.String()
+	}
+
+	//替换后的文件用新的过期时间，被删掉的文件 meta 也清理掉
+	archive := makeTarGz([]archiveFile{{Name: "old.txt", Body: "new", Type: tar.TypeReg}})
+	if resp := extract("1", http.Header{"X-Ttl": {"1h"}}, archive); !strings.HasPrefix(resp, `{"Code":0`) {
+		t.Fatal("extract fail:", resp)
+	}
+	if exp := old.ExpiresAt(); exp.Before(time.Now().Add(50*time.Minute)) || old.Expired() {
+		t.Error("ttl header not applied on replace:", exp)
+	}
+	if _, ok := gone.Get(MetaContentType, false); ok || !gone.ExpiresAt().IsZero() {
+		t.Error("meta of removed file kept")
+	}
+
+	//合并时没有过期头，覆盖的文件不再沿用旧的过期时间
+	old.SetExpiry(time.Now().Add(-time.Minute))
+	archive = makeZip([]archiveFile{{Name: "old.txt", Body: "merged"}})
+	if resp := extract("merge", nil, archive); !strings.HasPrefix(resp, `{"Code":0`) {
+		t.Fatal("merge fail:", resp)
+	}
+	if !old.ExpiresAt().IsZero() || readContent(old) != "merged" {
+		t.Error("stale expires_at kept on merge:", old.ExpiresAt())
+	}
+}
+
+func TestExtract_SwapUnsupported(t *testing.T) {
+	saved := testServer.storage
+	defer func() { testServer.storage = saved }()
+	testServer.storage = struct{ Storage }{saved} //隐藏 SwapDir，模拟 S3 这类不能原子交换目录的后端
+	defer testServer.MetaOf("/extract_noswap").Destroy()
+	testServer.MetaOf("/extract_noswap/keep.txt").SaveContent(strings.NewReader("keep"))
+
+	archive := makeZip([]archiveFile{{Name: "a.txt", Body: "a"}})
+	if resp := signedRequest("PUT", "/extract_noswap/?extract=1", archive); !strings.Contains(resp, `"Code":501`) {
+		t.Error("replace accepted without atomic swap:", resp)
+	}
+	if readContent(testServer.MetaOf("/extract_noswap/keep.txt")) != "keep" {
+		t.Error("content changed by rejected replace")
+	}
+	if resp := signedRequest("PUT", "/extract_noswap/?extract=merge", archive); !strings.HasPrefix(resp, `{"Code":0`) {
+		t.Error("merge rejected:", resp)
+	}
+}
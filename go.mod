@@ -5,9 +5,7 @@ go 1.19
 require (
 	github.com/google/uuid v1.6.0
 	github.com/horsley/svrkit v0.0.0-20200619152033-af5d5ee168e9
-)
-
-require (
-	golang.org/x/crypto v0.20.0 // indirect
-	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/crypto v0.20.0
+	golang.org/x/sys v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/horsley/svrkit"
+)
+
+// ipRules ip_check 的完整格式，也兼容旧的纯数组格式（全部视为 allow）
+// 条目可以是单个 IP、CIDR、"@组名"，数组格式中以 "!" 开头表示 deny
+type ipRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// AllowAll 没有 allow 条目时是否放行 deny 以外的全部 IP：对象格式中省略 allow 时放行；
+// 数组格式只有 "!" 条目时放行，空数组和旧版一样全部拒绝
+func (r *ipRules) AllowAll(legacy bool) bool {
+	if legacy {
+		return len(r.Allow) == 0 && len(r.Deny) > 0
+	}
+	return r.Allow == nil
+}
+
+type ipMatcher []*net.IPNet
+
+func (m ipMatcher) Contains(ip net.IP) bool {
+	for _, n := range m {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPRules 解析 ip_check，legacy 表示旧的数组格式
+func parseIPRules(content []byte) (*ipRules, bool, error) {
+	rules := &ipRules{}
+	var list []string
+	if err := json.Unmarshal(content, &list); err == nil {
+		for _, v := range list {
+			if strings.HasPrefix(v, "!") {
+				rules.Deny = append(rules.Deny, strings.TrimPrefix(v, "!"))
+			} else {
+				rules.Allow = append(rules.Allow, v)
+			}
+		}
+		return rules, true, nil
+	}
+
+	if err := json.Unmarshal(content, rules); err != nil {
+		return nil, false, err
+	}
+	return rules, false, nil
+}
+
+// parseIPEntries 把 IP/CIDR/组名条目解析为网段列表
+func parseIPEntries(entries []string, groups map[string][]string) (ipMatcher, error) {
+	var result ipMatcher
+	for _, v := range entries {
+		v = strings.TrimSpace(v)
+		if strings.HasPrefix(v, "@") {
+			members, ok := groups[v[1:]]
+			if !ok {
+				return nil, errors.New("unknown ip group: " + v)
+			}
+			sub, err := parseIPEntries(members, nil) //组内不允许再引用组
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, sub...)
+			continue
+		}
+
+		n, err := parseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+// parseCIDR 解析 CIDR，单个 IP 视为 /32 或 /128
+func parseCIDR(v string) (*net.IPNet, error) {
+	if strings.Contains(v, "/") {
+		_, n, err := net.ParseCIDR(v)
+		return n, err
+	}
+
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, errors.New("bad ip: " + v)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func validateIPGroups(content []byte) error {
+	var groups map[string][]string
+	if err := json.Unmarshal(content, &groups); err != nil {
+		return err
+	}
+	for _, members := range groups {
+		if _, err := parseIPEntries(members, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errFoundIPCheck = errors.New("found ip_check")
+
+// warnUntrustedProxies 旧版无条件采信 X-Forwarded-For，升级后未配置 trusted_proxies 时 ip_check 只看直连地址，
+// 部署在负载均衡后面时会按负载均衡的地址放行或拒绝，启动时发现有 ip_check 就提醒一次
+func (s *server) warnUntrustedProxies() {
+	if len(s.trustedProxies) > 0 {
+		return
+	}
+	var found string
+	err := walkStorage(s.storage, metaSubDir, func(name string, info fs.FileInfo) error {
+		if info.Name() != string(MetaIPCheck) {
+			return nil
+		}
+		found = path.Join("/", strings.TrimPrefix(path.Dir(name), metaSubDir))
+		return errFoundIPCheck
+	})
+	if errors.Is(err, errFoundIPCheck) {
+		log.Println("WARNING: ip_check found at", found, "but trusted_proxies is empty,",
+			"X-Forwarded-For and other proxy headers are ignored; set trusted_proxies when running behind a proxy")
+	}
+}
+
+// clientIP 取客户端 IP，仅当直连地址属于可信代理时才采信代理头，
+// 未配置可信代理时一律用直连地址，否则任何客户端都能用 X-Forwarded-For 伪造 IP 绕过 ip_check
+func (s *server) clientIP(r *svrkit.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil || !s.trustedProxies.Contains(remoteIP) {
+		return remote
+	}
+
+	for _, header := range s.realIPHeaders {
+		values := strings.Split(r.Header.Get(header), ",")
+		for i := len(values) - 1; i >= 0; i-- { //从右往左跳过可信代理，第一个不可信的就是客户端
+			ip := net.ParseIP(strings.TrimSpace(values[i]))
+			if ip == nil {
+				break
+			}
+			if !s.trustedProxies.Contains(ip) || i == 0 {
+				return ip.String()
+			}
+		}
+	}
+	return remote
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/horsley/svrkit"
+)
+
+func TestIPChecker(t *testing.T) {
+	testServer.MetaOf("/ipcheck_test").Set(MetaIPGroups, []byte(`{"office": ["10.1.0.0/16", "2001:db8::/32"]}`))
+	testServer.MetaOf("/ipcheck_test/a").Set(MetaIPCheck, []byte(`{"allow": ["@office", "1.2.3.4"], "deny": ["10.1.2.0/24"]}`))
+	testServer.MetaOf("/ipcheck_test/b").Set(MetaIPCheck, []byte(`["!192.168.0.0/16"]`))
+	testServer.MetaOf("/ipcheck_test/c").Set(MetaIPCheck, []byte(`[]`))
+	testServer.MetaOf("/ipcheck_test/d").Set(MetaIPCheck, []byte(`{"deny": ["192.168.0.0/16"]}`))
+	testServer.MetaOf("/ipcheck_test/e").Set(MetaIPCheck, []byte(`{"allow": []}`))
+	defer testServer.MetaOf("/ipcheck_test").Destroy()
+
+	checkA := testServer.MetaOf("/ipcheck_test/a/file").GetIPChecker()
+	for ip, want := range map[string]bool{
+		"10.1.0.8":    true,
+		"2001:db8::1": true,
+		"1.2.3.4":     true,
+		"10.1.2.3":    false,
+		"10.2.0.1":    false,
+		"":            false,
+	} {
+		if checkA(ip) != want {
+			t.Error("unexpected check result for", ip)
+		}
+	}
+
+	checkB := testServer.MetaOf("/ipcheck_test/b").GetIPChecker()
+	if !checkB("8.8.8.8") || checkB("192.168.1.1") {
+		t.Error("deny only rules not work")
+	}
+	if testServer.MetaOf("/ipcheck_test/c").GetIPChecker()("8.8.8.8") {
+		t.Error("empty legacy list allows all")
+	}
+	if checkD := testServer.MetaOf("/ipcheck_test/d").GetIPChecker(); !checkD("8.8.8.8") || checkD("192.168.1.1") {
+		t.Error("missing allow list not allow all")
+	}
+	if testServer.MetaOf("/ipcheck_test/e").GetIPChecker()("8.8.8.8") {
+		t.Error("empty allow list allows all")
+	}
+
+	if MetaIPCheck.Validate([]byte(`["10.0.0.0/33"]`)) == nil {
+		t.Error("bad cidr accepted")
+	}
+}
+
+func TestClientIP_NoProxies(t *testing.T) {
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/", nil)
+	mockReq.Header.Set("X-Forwarded-For", "10.0.0.1")
+	mockReq.Header.Set("X-Real-Ip", "10.0.0.1")
+	mockReq.RemoteAddr = "8.8.8.8:3456"
+	if ip := testServer.clientIP(&svrkit.Request{Request: mockReq}); ip != "8.8.8.8" {
+		t.Error("spoofed header used without trusted proxies:", ip)
+	}
+}
+
+func TestClientIP_TrustedProxies(t *testing.T) {
+	testServer.trustedProxies, _ = parseIPEntries([]string{"172.16.0.0/12"}, nil)
+	defer func() { testServer.trustedProxies = nil }()
+
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/", nil)
+	mockReq.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 172.16.0.9")
+	mockReq.RemoteAddr = "172.16.0.1:3456"
+	if ip := testServer.clientIP(&svrkit.Request{Request: mockReq}); ip != "1.2.3.4" {
+		t.Error("unexpected ip via trusted proxy:", ip)
+	}
+
+	mockReq.RemoteAddr = "8.8.8.8:3456"
+	if ip := testServer.clientIP(&svrkit.Request{Request: mockReq}); ip != "8.8.8.8" {
+		t.Error("header from untrusted peer used:", ip)
+	}
+}
+
+func TestWarnUntrustedProxies(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	testServer.MetaOf("/ipcheck_warn/a").Set(MetaIPCheck, []byte(`["1.2.3.4"]`))
+	defer testServer.MetaOf("/ipcheck_warn").Destroy()
+	testServer.warnUntrustedProxies()
+	if !strings.Contains(buf.String(), "trusted_proxies is empty") {
+		t.Error("no warning for ip_check without trusted proxies:", buf.String())
+	}
+
+	buf.Reset()
+	testServer.trustedProxies, _ = parseIPEntries([]string{"10.0.0.0/8"}, nil)
+	defer func() { testServer.trustedProxies = nil }()
+	testServer.warnUntrustedProxies()
+	if buf.Len() > 0 {
+		t.Error("warned with trusted proxies set:", buf.String())
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+// 命名 key 的权限范围
+const (
+	ScopeUpload = "upload" // 上传、断点续传、解压、回滚，整体替换目录的解压还需要 delete
+	ScopeDelete = "delete" // 删除
+	ScopeMeta   = "meta"   // 管理 meta（key 和 keys 除外）、生成下载链接、查询审计日志
+)
+
+var (
+	errNoKey       = errors.New("no key")
+	errAuthFail    = errors.New("auth fail")
+	errKeyScope    = errors.New("key scope not allowed")
+	errKeyNotAdmin = errors.New("named key cannot manage keys")
+)
+
+// namedKey 路径上的命名 key，对整个子树生效，可限定权限和有效期，单独吊销
+type namedKey struct {
+	Key     string
+	Scopes  []string
+	Expires time.Time `json:",omitempty"`
+}
+
+func (k *namedKey) Allow(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *namedKey) Expired() bool {
+	return !k.Expires.IsZero() && !time.Now().Before(k.Expires)
+}
+
+// parseNamedKeys 解析 keys meta，格式为 {"<name>": {"Key": "...", "Scopes": ["upload"], "Expires": "<RFC3339>"}}
+func parseNamedKeys(content []byte) (map[string]*namedKey, error) {
+	var keys map[string]*namedKey
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, err
+	}
+	for name, k := range keys {
+		if err := validateNamedKey(name, k); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func validateNamedKey(name string, k *namedKey) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n,=") {
+		return fmt.Errorf("bad key name: %q", name)
+	}
+	if k == nil || strings.TrimSpace(k.Key) == "" {
+		return fmt.Errorf("empty key: %s", name)
+	}
+	if len(k.Scopes) == 0 {
+		return fmt.Errorf("no scope: %s", name)
+	}
+	for _, s := range k.Scopes {
+		switch s {
+		case ScopeUpload, ScopeDelete, ScopeMeta:
+		default:
+			return fmt.Errorf("unknown scope: %s", s)
+		}
+	}
+	return nil
+}
+
+// NamedKeys 本路径自身设置的命名 key
+func (p *pathMeta) NamedKeys() map[string]*namedKey {
+	bin, ok := p.Get(MetaKeys, false)
+	if !ok {
+		return nil
+	}
+	keys, _ := parseNamedKeys(bin)
+	return keys
+}
+
+// NamedKeySource 从本路径向上查找命名 key，返回 key 和设置它的路径
+func (p *pathMeta) NamedKeySource(name string) (*namedKey, string, bool) {
+	for dir := p; dir.Valid(); dir = dir.Parent() {
+		if k, ok := dir.NamedKeys()[name]; ok {
+			return k, dir.Path(), true
+		}
+		if dir.Parent() == dir {
+			break
+		}
+	}
+	return nil, "", false
+}
+
+// SetNamedKey 添加或替换本路径的一个命名 key，k 为 nil 时吊销
+func (p *pathMeta) SetNamedKey(name string, k *namedKey) error {
+	unlock := p.srv.pathLocks.Lock(path.Join(p.metaName, string(MetaKeys)))
+	defer unlock()
+
+	keys := p.NamedKeys()
+	if keys == nil {
+		keys = make(map[string]*namedKey)
+	}
+	if k != nil {
+		keys[name] = k
+	} else if _, ok := keys[name]; !ok {
+		return nil
+	} else {
+		delete(keys, name)
+	}
+	if len(keys) == 0 {
+		return p.Del(MetaKeys)
+	}
+	bin, _ := json.MarshalIndent(keys, "", "    ")
+	return p.Set(MetaKeys, bin)
+}
+
+// keyAuth 通过认证的 key，Name 为空表示路径的 key
+type keyAuth struct {
+	Name  string
+	Level string
+	// Previous 用轮换宽限期内的旧 key 签名
+	Previous bool
+}
+
+// restricted 命名 key 和轮换前的旧 key 不能查看或管理 key 类配置，也不能轮换 key，防止提权或延续旧 key
+func (a keyAuth) restricted() bool {
+	return a.Name != "" || a.Previous
+}
+
+// authorize 校验写操作签名。请求带 X-Faas-Key-Name 头时用对应的命名 key 并检查 scopes 都允许，
+// 否则用路径的 key（轮换宽限期内旧 key 也有效），拥有全部权限
+func (s *server) authorize(r *svrkit.Request, p *pathMeta, scopes ...string) (keyAuth, error) {
+	name := r.Header.Get(tool.KeyNameHeader)
+	if name == "" {
+		writeKeys, level, ok := p.WriteKeys()
+		if !ok {
+			return keyAuth{}, errNoKey
+		}
+		i := s.matchSign(r, writeKeys...)
+		if i < 0 {
+			return keyAuth{}, errAuthFail
+		}
+		return keyAuth{Level: level, Previous: i > 0}, nil
+	}
+
+	if !p.Valid() {
+		return keyAuth{}, errNoKey
+	}
+	k, level, ok := p.NamedKeySource(name)
+	if !ok {
+		s.metrics.authFailures.Inc("named_key", "unknown")
+		return keyAuth{}, errAuthFail
+	}
+	if !s.checkSign(r, k.Key) {
+		return keyAuth{}, errAuthFail
+	}
+	if k.Expired() {
+		s.metrics.authFailures.Inc("named_key", "expired")
+		return keyAuth{}, errAuthFail
+	}
+	for _, scope := range scopes {
+		if !k.Allow(scope) {
+			s.metrics.authFailures.Inc("named_key", "scope")
+			return keyAuth{}, errKeyScope
+		}
+	}
+	return keyAuth{Name: name, Level: level}, nil
+}
+
+// writeAuthError 输出 authorize 的错误
+func writeAuthError(rw *svrkit.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoKey):
+		rw.WriteCommonResponse(403, "非法目标", nil)
+	case errors.Is(err, errKeyScope), errors.Is(err, errKeyNotAdmin):
+		rw.WriteCommonResponse(403, "权限不足", nil)
+	default:
+		rw.WriteCommonResponse(401, "认证失败", nil)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/faas/tool"
+)
+
+func namedKeyRequest(t *testing.T, method, target, name, key, body string) int {
+	mockReq, _ := http.NewRequest(method, "http://abc.com"+target, strings.NewReader(body))
+	if name != "" {
+		tool.KeyName(name)(mockReq)
+	}
+	if err := tool.SignRequest(key, mockReq); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, mockReq)
+
+	var resp struct {
+		Code int
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal("bad response:", rec.Body.String())
+	}
+	return resp.Code
+}
+
+func TestNamedKeys(t *testing.T) {
+	defer testServer.MetaOf("/keys_test").Destroy()
+	testServer.MetaOf("/keys_test").Set(MetaKeys, []byte(`{
+		"ci": {"Key": "ci-secret", "Scopes": ["upload"]},
+		"ops": {"Key": "ops-secret", "Scopes": ["delete", "meta"]},
+		"old": {"Key": "old-secret", "Scopes": ["upload"], "Expires": "2020-01-01T00:00:00Z"}
+	}`))
+
+	if code := namedKeyRequest(t, "PUT", "/keys_test/sub/a.txt", "ci", "ci-secret", "a"); code != 0 {
+		t.Fatal("upload with named key fail:", code)
+	}
+	entries, _ := testServer.audit.Query("/keys_test/sub/a.txt", time.Time{}, 1)
+	if len(entries) != 1 || entries[0].KeyName != "ci" || entries[0].KeyLevel != "/keys_test" {
+		t.Error("named key not audited:", entries)
+	}
+
+	cases := []struct {
+		method, target, name, key string
+		code                      int
+	}{
+		{"DELETE", "/keys_test/sub/a.txt", "ci", "ci-secret", 403},
+		{"PUT", "/keys_test/sub/a.txt", "ci", "bad-secret", 401},
+		{"PUT", "/keys_test/sub/a.txt", "old", "old-secret", 401},
+		{"PUT", "/keys_test/sub/a.txt", "nobody", "ci-secret", 401},
+		{"PUT", "/other/a.txt", "ci", "ci-secret", 401},
+		{"PUT", "/keys_test/sub/a.txt", "ops", "ops-secret", 403},
+		{"PUT", "/_meta/keys_test?key=no_index", "ops", "ops-secret", 0},
+		{"GET", "/_meta/keys_test?key=keys", "ops", "ops-secret", 403},
+		{"GET", "/_meta/keys_test/sub?key=key", "ops", "ops-secret", 403},
+		{"PUT", "/_meta/keys_test/sub?key=key", "ops", "ops-secret", 403},
+		{"DELETE", "/keys_test/sub/a.txt", "ops", "ops-secret", 0},
+	}
+	for _, c := range cases {
+		if code := namedKeyRequest(t, c.method, c.target, c.name, c.key, "a"); code != c.code {
+			t.Error(c.method, c.target, c.name, "unexpected code:", code)
+		}
+	}
+
+	//单独吊销
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	if code := namedKeyRequest(t, "DELETE", "/_meta/keys_test?key=keys&name=ci", "", peekRootKey, ""); code != 0 {
+		t.Fatal("revoke fail:", code)
+	}
+	if code := namedKeyRequest(t, "PUT", "/keys_test/sub/a.txt", "ci", "ci-secret", "a"); code != 401 {
+		t.Error("revoked key accepted:", code)
+	}
+	if _, ok := testServer.MetaOf("/keys_test").NamedKeys()["ops"]; !ok {
+		t.Error("other key revoked")
+	}
+
+	if code := namedKeyRequest(t, "PUT", "/_meta/keys_test?key=keys&name=ci2", "", peekRootKey, `{"Key": "x", "Scopes": ["all"]}`); code != 400 {
+		t.Error("unknown scope accepted:", code)
+	}
+	if code := namedKeyRequest(t, "PUT", "/_meta/keys_test?key=keys&name=ci2", "", peekRootKey, `{"Key": "ci2-secret", "Scopes": ["upload"]}`); code != 0 {
+		t.Error("add key fail:", code)
+	}
+	if code := namedKeyRequest(t, "PUT", "/keys_test/b.txt", "ci2", "ci2-secret", "b"); code != 0 {
+		t.Error("added key rejected:", code)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horsley/svrkit"
+)
+
+// linksSubDir 限次下载链接的计数存储目录
+const linksSubDir = "links"
+
+const defaultLinkTTL = 24 * time.Hour
+
+var (
+	errLinkInvalid = errors.New("bad link")
+	errLinkExpired = errors.New("link expired")
+	errLinkUsedUp  = errors.New("link used up")
+)
+
+// linkSignature 下载链接的签名，以路径的 key 计算，路径上生效的 link_secret 也参与签名，
+// 修改某一级目录的 link_secret 即可让其下所有已发出的链接失效
+func linkSignature(p *pathMeta, expires int64, maxDownloads int) (string, bool) {
+	writeKey, ok := p.WriteKey()
+	if !ok {
+		return "", false
+	}
+	secret, _ := p.GetText(MetaLinkSecret, true)
+	mac := hmac.New(sha256.New, []byte(writeKey))
+	fmt.Fprintf(mac, "%s\n%d\n%d\n%s", p.Path(), expires, maxDownloads, secret)
+	return hex.EncodeToString(mac.Sum(nil)), true
+}
+
+// linkCounter 限次链接已下载的次数
+type linkCounter struct {
+	Expires int64
+	Count   int
+}
+
+func linkCounterName(sig string) string {
+	return path.Join(linksSubDir, sig)
+}
+
+// linkParams 下载链接允许带的参数，签名不覆盖其他参数，不能让链接用于 ?versions、?watch 等，
+// archive 只选择目录打包的格式，内容仍是链接覆盖的目录
+var linkParams = map[string]bool{"expires": true, "max": true, "sig": true, "archive": true}
+
+// downloadLink 校验通过的下载链接
+type downloadLink struct {
+	srv          *server
+	sig          string
+	expires      int64
+	maxDownloads int
+}
+
+// checkLink 校验 ?expires=&max=&sig= 下载链接，不计下载次数
+func checkLink(p *pathMeta, q url.Values) (*downloadLink, error) {
+	for k := range q {
+		if !linkParams[k] {
+			return nil, errLinkInvalid
+		}
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, errLinkInvalid
+	}
+	maxDownloads := 0
+	if v := q.Get("max"); v != "" {
+		if maxDownloads, err = strconv.Atoi(v); err != nil || maxDownloads < 0 {
+			return nil, errLinkInvalid
+		}
+	}
+
+	sig := q.Get("sig")
+	expected, ok := linkSignature(p, expires, maxDownloads)
+	if !ok || !hmac.Equal([]byte(sig), []byte(expected)) {
+		return nil, errLinkInvalid
+	}
+	if time.Now().Unix() > expires {
+		return nil, errLinkExpired
+	}
+	return &downloadLink{srv: p.srv, sig: sig, expires: expires, maxDownloads: maxDownloads}, nil
+}
+
+// consume 限次链接计入一次下载
+func (l *downloadLink) consume() error {
+	if l.maxDownloads == 0 {
+		return nil
+	}
+
+	unlock := l.srv.pathLocks.Lock(linkCounterName(l.sig))
+	defer unlock()
+
+	counter := linkCounter{Expires: l.expires}
+	if bin, err := readStorageFile(l.srv.storage, linkCounterName(l.sig)); err == nil {
+		json.Unmarshal(bin, &counter)
+	}
+	if counter.Count >= l.maxDownloads {
+		return errLinkUsedUp
+	}
+	counter.Count++
+	bin, _ := json.Marshal(counter)
+	return l.srv.storage.WriteFile(linkCounterName(l.sig), strings.NewReader(string(bin)))
+}
+
+// sweepLinkCounters 删除已过期链接的计数
+func (s *server) sweepLinkCounters() {
+	entries, err := s.storage.ReadDir(linksSubDir)
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for _, info := range entries {
+		var counter linkCounter
+		bin, err := readStorageFile(s.storage, linkCounterName(info.Name()))
+		if err != nil || json.Unmarshal(bin, &counter) != nil || counter.Expires < now {
+			s.storage.Remove(linkCounterName(info.Name()))
+		}
+	}
+}
+
+// linkFailReason 链接校验失败原因，用作指标标签
+func linkFailReason(err error) string {
+	switch {
+	case errors.Is(err, errLinkInvalid):
+		return "invalid"
+	case errors.Is(err, errLinkExpired):
+		return "expired"
+	case errors.Is(err, errLinkUsedUp):
+		return "used_up"
+	}
+	return "other"
+}
+
+type linkResult struct {
+	URL          string
+	Expires      time.Time
+	MaxDownloads int `json:",omitempty"`
+}
+
+// linkHandler 生成下载链接，POST /path?link&ttl=1h&max=1，需用该路径的 key 或有 meta 权限的命名 key 签名。
+// 持有链接即可下载，不再检查 basic_auth、ip_check 和 client_cert；max 为 0 时不限次数，
+// 限次链接每个 GET 请求计一次，包括 Range 请求
+func (s *server) linkHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+	targetMeta := s.MetaOf(r.URL.Path)
+	auth, err := s.authorize(r, targetMeta, ScopeMeta)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	q := r.URL.Query()
+	ttl := defaultLinkTTL
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			rw.WriteCommonResponse(400, "ttl 格式错误", nil)
+			return
+		}
+		ttl = d
+	}
+	maxDownloads := 0
+	if v := q.Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			rw.WriteCommonResponse(400, "max 格式错误", nil)
+			return
+		}
+		maxDownloads = n
+	}
+	s.sweepLinkCounters()
+
+	expires := time.Now().Add(ttl).Unix()
+	sig, _ := linkSignature(targetMeta, expires, maxDownloads)
+	linkQuery := url.Values{"expires": {strconv.FormatInt(expires, 10)}, "sig": {sig}}
+	if maxDownloads > 0 {
+		linkQuery.Set("max", strconv.Itoa(maxDownloads))
+	}
+	u := url.URL{Path: targetMeta.Path(), RawQuery: linkQuery.Encode()}
+
+	entry := s.newAuditEntry(r, targetMeta, auth, false)
+	entry.Op = AuditLink
+	s.audit.Record(entry)
+	rw.WriteCommonResponse(0, "", linkResult{URL: u.String(), Expires: time.Unix(expires, 0), MaxDownloads: maxDownloads})
+}
+
+// linkAccess 用下载链接代替读权限检查，内容已过期时也在这里返回 410，不计下载次数。
+// 失败时输出响应并返回 false
+func (s *server) linkAccess(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta) bool {
+	link, err := checkLink(targetMeta, r.URL.Query())
+	if err == nil && targetMeta.Expired() {
+		rw.HTTPError(http.StatusGone, "expired")
+		return false
+	}
+	if err == nil && r.Method == "GET" {
+		if err = link.consume(); err != nil && !errors.Is(err, errLinkUsedUp) {
+			log.Println("Save link counter err:", err, targetMeta.Path())
+		}
+	}
+	if err == nil {
+		return true
+	}
+	s.metrics.authFailures.Inc("link", linkFailReason(err))
+	switch {
+	case errors.Is(err, errLinkExpired), errors.Is(err, errLinkUsedUp):
+		rw.HTTPError(http.StatusGone, err.Error())
+	case errors.Is(err, errLinkInvalid):
+		rw.HTTPError(http.StatusForbidden, err.Error())
+	default:
+		rw.HTTPError(http.StatusInternalServerError, "check link fail")
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/faas/tool"
+)
+
+func getStatus(t *testing.T, link string) (int, string) {
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bin, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(bin)
+}
+
+func TestDownloadLink(t *testing.T) {
+	svr := httptest.NewServer(testServer)
+	defer svr.Close()
+	defer testServer.MetaOf("/link_test").Destroy()
+
+	testServer.MetaOf("/link_test/a.txt").SaveContent(strings.NewReader("secret content"))
+	hash, _ := hashPassword("secret")
+	testServer.MetaOf("/link_test").Set(MetaReadAuth, []byte("user:"+hash))
+	testServer.MetaOf("/link_test").Set(MetaIPCheck, []byte(`["10.0.0.1"]`))
+
+	if code, _ := getStatus(t, svr.URL+"/link_test/a.txt"); code != http.StatusUnauthorized {
+		t.Fatal("protected file served:", code)
+	}
+
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	link, err := tool.CreateLink(svr.URL+"/link_test/a.txt", peekRootKey, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := getStatus(t, link); code != http.StatusOK || body != "secret content" {
+		t.Error("link rejected:", code, body)
+	}
+	if code, _ := getStatus(t, strings.Replace(link, "/a.txt", "/b.txt", 1)); code != http.StatusForbidden {
+		t.Error("link accepted for other path:", code)
+	}
+
+	//修改 link_secret 后已发出的链接全部失效
+	testServer.MetaOf("/link_test").Set(MetaLinkSecret, []byte("rotated"))
+	if code, _ := getStatus(t, link); code != http.StatusForbidden {
+		t.Error("revoked link accepted:", code)
+	}
+
+	expires := time.Now().Add(-time.Minute).Unix()
+	sig, _ := linkSignature(testServer.MetaOf("/link_test/a.txt"), expires, 0)
+	expired := svr.URL + "/link_test/a.txt?expires=" + strconv.FormatInt(expires, 10) + "&sig=" + sig
+	if code, _ := getStatus(t, expired); code != http.StatusGone {
+		t.Error("expired link accepted:", code)
+	}
+}
+
+func TestDownloadLink_MaxDownloads(t *testing.T) {
+	svr := httptest.NewServer(testServer)
+	defer svr.Close()
+	defer testServer.MetaOf("/link_once").Destroy()
+	testServer.MetaOf("/link_once").SaveContent(strings.NewReader("once"))
+
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	link, err := tool.CreateLink(svr.URL+"/link_once", peekRootKey, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := http.Head(link); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("head fail:", err)
+	}
+	//签名不覆盖其他参数，链接不能用于历史版本、订阅等
+	for _, extra := range []string{"&versions", "&version=20200101T000000.000000000", "&watch", "&usage"} {
+		if code, _ := getStatus(t, link+extra); code != http.StatusForbidden {
+			t.Error("link accepted with extra query:", extra, code)
+		}
+	}
+	//内容已过期时返回 410，不消耗下载次数
+	testServer.MetaOf("/link_once").SetExpiry(time.Now().Add(-time.Minute))
+	if code, _ := getStatus(t, link); code != http.StatusGone {
+		t.Error("expired content served:", code)
+	}
+	testServer.MetaOf("/link_once").SetExpiry(time.Time{})
+
+	if code, body := getStatus(t, link); code != http.StatusOK || body != "once" {
+		t.Error("first download fail:", code, body)
+	}
+	if code, _ := getStatus(t, link); code != http.StatusGone {
+		t.Error("one-time link reused:", code)
+	}
+	if code, _ := getStatus(t, strings.Replace(link, "max=1", "max=2", 1)); code != http.StatusForbidden {
+		t.Error("tampered max accepted:", code)
+	}
+}
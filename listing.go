@@ -0,0 +1,206 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horsley/svrkit"
+)
+
+const defaultListPageSize = 100
+const maxListPageSize = 1000
+
+type dirEntry struct {
+	Name        string
+	IsDir       bool
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	HasMeta     bool
+}
+
+type dirListing struct {
+	Path     string
+	Total    int
+	Page     int
+	PageSize int
+	Sort     string
+	Order    string
+	PrevPage int
+	NextPage int
+	Items    []dirEntry
+}
+
+// wantJSON 客户端是否要求 json 格式的列表
+func wantJSON(r *svrkit.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (s *server) listDir(targetMeta *pathMeta, r *svrkit.Request) (*dirListing, error) {
+	entries, err := s.storage.ReadDir(targetMeta.ContentName())
+	if err != nil {
+		return nil, err
+	}
+
+	q := r.URL.Query()
+	result := &dirListing{
+		Path:     targetMeta.Path(),
+		Page:     1,
+		PageSize: defaultListPageSize,
+		Sort:     q.Get("sort"),
+		Order:    q.Get("order"),
+	}
+	if p, err := strconv.Atoi(q.Get("page")); err == nil && p > 0 {
+		result.Page = p
+	}
+	if n, err := strconv.Atoi(q.Get("size")); err == nil && n > 0 {
+		result.PageSize = n
+	}
+	if result.PageSize > maxListPageSize {
+		result.PageSize = maxListPageSize
+	}
+	if result.Order != "desc" {
+		result.Order = "asc"
+	}
+
+	//先按目录项排序分页，只为当前页读取 meta；过期用内存中的索引判断，目录本身是否过期已在读取时检查
+	now := time.Now()
+	items := make([]dirEntry, 0, len(entries))
+	for _, info := range entries {
+		if s.expiries.Expired(path.Join(result.Path, info.Name()), now) {
+			continue
+		}
+		item := dirEntry{
+			Name:    info.Name(),
+			IsDir:   info.IsDir(),
+			ModTime: info.ModTime(),
+		}
+		if !info.IsDir() {
+			item.Size = info.Size()
+		}
+		items = append(items, item)
+	}
+
+	result.Total = len(items)
+
+	var less func(a, b dirEntry) bool
+	switch result.Sort {
+	case "size":
+		less = func(a, b dirEntry) bool { return a.Size < b.Size }
+	case "mtime":
+		less = func(a, b dirEntry) bool { return a.ModTime.Before(b.ModTime) }
+	default:
+		result.Sort = "name"
+		less = func(a, b dirEntry) bool { return a.Name < b.Name }
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if result.Order == "desc" {
+			return less(items[j], items[i])
+		}
+		return less(items[i], items[j])
+	})
+
+	start := (result.Page - 1) * result.PageSize
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + result.PageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	result.Items = items[start:end]
+	for i := range result.Items {
+		item := &result.Items[i]
+		childMeta := s.MetaOf(path.Join(result.Path, item.Name))
+		item.HasMeta = len(childMeta.Own()) > 0
+		if item.IsDir {
+			continue
+		}
+		if ct, ok := childMeta.GetText(MetaContentType, false); ok {
+			item.ContentType = ct
+		} else {
+			item.ContentType = mime.TypeByExtension(path.Ext(item.Name))
+		}
+	}
+	if result.Page > 1 {
+		result.PrevPage = result.Page - 1
+	}
+	if end < len(items) {
+		result.NextPage = result.Page + 1
+	}
+	return result, nil
+}
+
+// dirListHandler 输出目录列表，支持 json 和 html 两种格式
+func (s *server) dirListHandler(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta) {
+	listing, err := s.listDir(targetMeta, r)
+	if err != nil {
+		rw.HTTPError(http.StatusInternalServerError, "list dir fail")
+		return
+	}
+
+	if wantJSON(r) {
+		rw.WriteCommonResponse(0, "", listing)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") { //页面内用相对链接
+		rw.Redirect(r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHTMLString(dirListTemplate, listing)
+}
+
+const dirListTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 960px; color: #24292e; }
+h1 { font-size: 1.4em; font-weight: normal; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .4em .8em; border-bottom: 1px solid #eaecef; }
+th a { color: inherit; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+a { color: #0366d6; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.pager { margin-top: 1em; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr>
+<th><a href="?sort=name&order={{if and (eq .Sort "name") (eq .Order "asc")}}desc{{else}}asc{{end}}">Name</a></th>
+<th><a href="?sort=size&order={{if and (eq .Sort "size") (eq .Order "asc")}}desc{{else}}asc{{end}}">Size</a></th>
+<th><a href="?sort=mtime&order={{if and (eq .Sort "mtime") (eq .Order "asc")}}desc{{else}}asc{{end}}">Modified</a></th>
+<th>Type</th>
+</tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td><td></td></tr>{{end}}
+{{range .Items}}<tr>
+<td><a href="./{{.Name}}{{if .IsDir}}/{{end}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td>
+<td class="num">{{if not .IsDir}}{{.Size}}{{end}}</td>
+<td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.ContentType}}</td>
+</tr>{{end}}
+</table>
+<div class="pager">
+{{if .PrevPage}}<a href="?sort={{.Sort}}&order={{.Order}}&size={{.PageSize}}&page={{.PrevPage}}">&larr; prev</a>{{end}}
+{{.Total}} items, page {{.Page}}
+{{if .NextPage}}<a href="?sort={{.Sort}}&order={{.Order}}&size={{.PageSize}}&page={{.NextPage}}">next &rarr;</a>{{end}}
+</div>
+</body>
+</html>
+`
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/svrkit"
+)
+
+func TestDirList(t *testing.T) {
+	testServer.MetaOf("/list_test/a.txt").SaveContent(strings.NewReader("a"))
+	testServer.MetaOf("/list_test/bb.json").SaveContent(strings.NewReader("bbbb"))
+	testServer.MetaOf("/list_test/sub/c").SaveContent(strings.NewReader("cc"))
+	testServer.MetaOf("/list_test/bb.json").Set(MetaContentType, []byte("text/x-custom"))
+	defer testServer.MetaOf("/list_test").Destroy()
+
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/list_test/?format=json&sort=size&order=desc&size=2", nil)
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+
+	var resp struct {
+		Code int
+		Data dirListing
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal("bad response:", rec.Body.String())
+	}
+	if resp.Data.Total != 3 || len(resp.Data.Items) != 2 || resp.Data.NextPage != 2 {
+		t.Fatal("unexpected paging:", rec.Body.String())
+	}
+	if item := resp.Data.Items[0]; item.Name != "bb.json" || item.Size != 4 || item.ContentType != "text/x-custom" || !item.HasMeta {
+		t.Error("unexpected first item:", item)
+	}
+	if item := resp.Data.Items[1]; item.Name != "a.txt" || item.HasMeta {
+		t.Error("unexpected second item:", item)
+	}
+
+	mockReq, _ = http.NewRequest("GET", "http://abc.com/list_test/", nil)
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if body := rec.Body.String(); !strings.Contains(body, `href="./sub/"`) || !strings.Contains(body, "Index of /list_test") {
+		t.Error("unexpected html:", body)
+	}
+
+	//过期的文件不再列出
+	testServer.MetaOf("/list_test/a.txt").SetExpiry(time.Now().Add(-time.Minute))
+	defer testServer.expiries.Track("/list_test/a.txt", time.Time{})
+	jsonReq, _ := http.NewRequest("GET", "http://abc.com/list_test/?format=json", nil)
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: jsonReq})
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data.Total != 2 || len(resp.Data.Items) != 2 || resp.Data.Items[0].Name != "bb.json" {
+		t.Error("expired file listed:", rec.Body.String())
+	}
+
+	testServer.MetaOf("/list_test").Set(MetaNoIndex, []byte("1"))
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if rec.Code != http.StatusForbidden {
+		t.Error("no_index not honored", rec.Code)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/horsley/svrkit"
+)
+
+// setupLog 设置标准库 log 的输出格式，json 时每行一个对象
+func setupLog(format string) {
+	if format == "json" {
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{out: os.Stderr})
+	}
+}
+
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	bin, _ := json.Marshal(map[string]string{
+		"time": time.Now().Format(time.RFC3339Nano),
+		"msg":  strings.TrimRight(string(p), "\n"),
+	})
+	_, err := w.out.Write(append(bin, '\n'))
+	return len(p), err
+}
+
+type accessEntry struct {
+	Time      time.Time
+	IP        string
+	Method    string
+	URI       string
+	Status    int
+	Bytes     int64
+	Duration  float64
+	UserAgent string `json:",omitempty"`
+	Referer   string `json:",omitempty"`
+}
+
+// openLogOutput "-" 为标准输出，否则为按大小轮转的文件
+func openLogOutput(name string, maxSize int64, maxBackups int) (io.Writer, error) {
+	if name == "-" {
+		return os.Stdout, nil
+	}
+	return openRotatingFile(name, maxSize, maxBackups)
+}
+
+// writeAccessLog 每个请求一行 json，旧版上传 query 中的 key 会被隐去
+func (s *server) writeAccessLog(r *http.Request, status int, bytes int64, duration time.Duration) {
+	if s.accessLog == nil {
+		return
+	}
+
+	uri := r.URL.Path
+	if q := r.URL.Query(); len(q) > 0 {
+		for _, k := range []string{"k", "sig"} {
+			if q.Has(k) {
+				q.Set(k, "-")
+			}
+		}
+		uri += "?" + q.Encode()
+	}
+	bin, _ := json.Marshal(accessEntry{
+		Time:      time.Now(),
+		IP:        s.clientIP(&svrkit.Request{Request: r}),
+		Method:    r.Method,
+		URI:       uri,
+		Status:    status,
+		Bytes:     bytes,
+		Duration:  duration.Seconds(),
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+	})
+	s.accessLog.Write(append(bin, '\n'))
+}
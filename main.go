@@ -1,40 +1,120 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
-
-	"github.com/google/uuid"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-var (
-	LISTEN   = os.Getenv("LISTEN")
-	STORAGE  = os.Getenv("STORAGE")
-	ROOT_KEY = os.Getenv("ROOT_KEY")
-)
+func main() {
+	conf, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln("load config err:", err)
+	}
+	setupLog(conf.LogFormat)
 
-func init() {
-	if LISTEN == "" {
-		LISTEN = ":24303" //default listen addr
+	s, err := newServer(conf)
+	if err != nil {
+		log.Fatalln("init server err:", err)
 	}
-	if STORAGE == "" {
-		STORAGE = "./data" //default storage dir
+
+	if len(args) > 0 {
+		s.runCommand(args)
+		return
 	}
 
-	var ok bool
-	if ROOT_KEY == "" {
-		ROOT_KEY, ok = MetaOf("/").WriteKey()
-		if !ok {
-			ROOT_KEY = uuid.NewString()
+	svr := &http.Server{
+		Addr:              conf.Listen,
+		Handler:           s,
+		ReadHeaderTimeout: conf.Timeouts.ReadHeader,
+		ReadTimeout:       conf.Timeouts.Read,
+		WriteTimeout:      conf.Timeouts.Write,
+		IdleTimeout:       conf.Timeouts.Idle,
+	}
 
-			MetaOf("/").SetWriteKey(ROOT_KEY)
-			log.Println("generated root key:", ROOT_KEY)
+	if conf.TLS.Cert != "" {
+		reloader, err := newCertReloader(conf.TLS)
+		if err != nil {
+			log.Fatalln("load tls cert err:", err)
 		}
+		go reloader.Watch()
+		svr.TLSConfig = reloader.TLSConfig()
+	}
+
+	if err := s.cleanupPartialUploads(); err != nil {
+		log.Println("cleanup partial uploads err:", err)
+	}
+	go s.expiries.Run(expirySweepInterval)
+
+	go func() {
+		log.Println("listening at", conf.Listen)
+		var err error
+		if svr.TLSConfig != nil {
+			err = svr.ListenAndServeTLS("", "") //证书由 TLSConfig.GetCertificate 提供
+		} else {
+			err = svr.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalln("server exit:", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	log.Println("received signal:", <-stop)
+
+	if err := s.shutdown(svr, conf.Timeouts.Shutdown); err != nil {
+		log.Println("shutdown err:", err)
 	}
+	log.Println("server exit")
 }
 
-func main() {
-	log.Println("listening at", LISTEN)
-	http.ListenAndServe(LISTEN, newServer())
+// shutdown 停止接受新连接，等待进行中的请求完成，超时后强制关闭，最后清理未完成的上传
+func (s *server) shutdown(svr *http.Server, timeout time.Duration) error {
+	s.changes.Close()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := svr.Shutdown(ctx)
+	if err != nil {
+		svr.Close() //中断剩余连接，进行中的上传会失败并被清理
+	}
+
+	if cleanupErr := s.cleanupPartialUploads(); err == nil {
+		err = cleanupErr
+	}
+	return err
+}
+
+// runCommand 运维子命令，如 faas migrate-basic-auth
+func (s *server) runCommand(args []string) {
+	switch args[0] {
+	case "migrate-basic-auth":
+		n, err := s.migrateBasicAuth()
+		if err != nil {
+			log.Fatalln("migrate basic_auth err:", err)
+		}
+		log.Println("migrated basic_auth files:", n)
+	case "rotate-key":
+		if err := s.rotateKeyCommand(args[1:]); err != nil {
+			log.Fatalln("rotate key err:", err)
+		}
+	case "reencrypt":
+		n, err := s.reencryptStorage()
+		if err != nil {
+			log.Fatalln("reencrypt err:", err)
+		}
+		log.Println("reencrypted files:", n)
+	default:
+		log.Fatalln("unknown command:", args[0])
+	}
 }
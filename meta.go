@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"net"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/horsley/svrkit"
+	"github.com/google/uuid"
 )
 
 type MetaKey string
@@ -19,69 +25,202 @@ const (
 	MetaReadAuth    = MetaKey("basic_auth")
 	MetaContentType = MetaKey("content-type")
 	MetaNoIndex     = MetaKey("no_index")
+	MetaVersions    = MetaKey("versions")
+	MetaIPGroups    = MetaKey("ip_groups")
+	MetaClientCert  = MetaKey("client_cert")
+	MetaMaxSize     = MetaKey("max_size")
+	MetaQuota       = MetaKey("quota")
+	MetaLinkSecret  = MetaKey("link_secret")
+	MetaTTL         = MetaKey("ttl")
+	MetaExpiresAt   = MetaKey("expires_at")
+	MetaKeys        = MetaKey("keys")
+	MetaPrevKey     = MetaKey("key_previous")
 )
 
+// Valid 是否已知的 meta key，避免通过管理接口写入任意文件
+func (k MetaKey) Valid() bool {
+	switch k {
+	case MetaWriteKey, MetaIPCheck, MetaReadAuth, MetaContentType, MetaNoIndex, MetaVersions, MetaIPGroups,
+		MetaClientCert, MetaMaxSize, MetaQuota, MetaLinkSecret,
+		MetaTTL, MetaExpiresAt, MetaKeys, MetaPrevKey:
+		return true
+	}
+	return false
+}
+
+// Inheritable 读取生效值时是否沿用上级目录的设置，keys 在每一级分别生效，不按覆盖处理
+func (k MetaKey) Inheritable() bool {
+	return k != MetaContentType && k != MetaExpiresAt && k != MetaKeys && k != MetaPrevKey
+}
+
+// Validate 检查 meta 内容格式
+func (k MetaKey) Validate(content []byte) error {
+	switch k {
+	case MetaWriteKey, MetaLinkSecret:
+		if len(strings.TrimSpace(string(content))) == 0 {
+			return errors.New("empty key")
+		}
+	case MetaReadAuth:
+		_, err := parseBasicAuth(content)
+		return err
+	case MetaIPCheck:
+		rules, _, err := parseIPRules(content)
+		if err != nil {
+			return err
+		}
+		for _, v := range append(rules.Allow, rules.Deny...) {
+			if !strings.HasPrefix(v, "@") { //组可能在上级定义，这里只检查 IP 格式
+				if _, err := parseCIDR(v); err != nil {
+					return err
+				}
+			}
+		}
+	case MetaIPGroups:
+		return validateIPGroups(content)
+	case MetaClientCert:
+		_, err := parseClientCertRules(content)
+		return err
+	case MetaMaxSize:
+		_, err := parseMaxSize(content)
+		return err
+	case MetaQuota:
+		_, err := parseQuota(content)
+		return err
+	case MetaKeys:
+		_, err := parseNamedKeys(content)
+		return err
+	case MetaPrevKey:
+		_, err := parsePreviousKey(content)
+		return err
+	case MetaTTL:
+		_, err := parseTTL(content)
+		return err
+	case MetaExpiresAt:
+		_, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content)))
+		return err
+	case MetaVersions:
+		n, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err == nil && n < 0 {
+			return errors.New("negative versions")
+		}
+		return err
+	}
+	return nil
+}
+
 type pathMeta struct {
-	root        string
-	metaAbsPath string
-	srcPath     string
+	srv      *server
+	root     string
+	metaName string
+	srcPath  string
 }
 
 const metaSubDir = "meta"
 const contentSubDir = "content"
+const stagingSubDir = "staging"
 
-func MetaOf(path string) *pathMeta {
-	metaRoot := filepath.Join(STORAGE, metaSubDir)
-	absPath := filepath.Join(metaRoot, path)
+// metaNameOf 路径在存储中的 meta 目录名，跳出根目录时返回 false
+func metaNameOf(srcPath string) (string, bool) {
+	metaName := path.Join(metaSubDir, srcPath)
 
-	if !strings.HasPrefix(absPath, metaRoot) { // directory path traversal attack
-		return nil
+	if metaName != metaSubDir && !strings.HasPrefix(metaName, metaSubDir+"/") { // directory path traversal attack
+		return "", false
 	}
+	return metaName, true
+}
 
-	return &pathMeta{metaRoot, absPath, path}
+// MetaOf 路径在本实例存储中的 meta，路径跳出根目录时返回 nil
+func (s *server) MetaOf(srcPath string) *pathMeta {
+	metaName, ok := metaNameOf(srcPath)
+	if !ok {
+		return nil
+	}
+	return &pathMeta{s, metaSubDir, metaName, srcPath}
 }
 
 func (p *pathMeta) Valid() bool {
 	return p != nil
 }
 
-func (p *pathMeta) ContentPath() string {
+// Path 规范化后的请求路径
+func (p *pathMeta) Path() string {
+	return path.Clean("/" + p.srcPath)
+}
+
+// ContentName 内容在存储后端中的名字
+func (p *pathMeta) ContentName() string {
 	if !p.Valid() {
 		return ""
 	}
-	return filepath.Join(STORAGE, contentSubDir, p.srcPath)
+	return path.Join(contentSubDir, p.srcPath)
 }
 
 func (p *pathMeta) IsDir() bool {
-	info, err := os.Stat(p.ContentPath())
+	info, err := p.StatContent()
 	return err == nil && info.IsDir()
 }
 
+func (p *pathMeta) StatContent() (fs.FileInfo, error) {
+	return p.srv.storage.Stat(p.ContentName())
+}
+
+func (p *pathMeta) OpenContent() (File, error) {
+	return p.srv.storage.Open(p.ContentName())
+}
+
 func (p *pathMeta) SaveContent(rd io.Reader) error {
-	targetFilePath := p.ContentPath()
-	if targetFilePath == "" {
+	targetName := p.ContentName()
+	if targetName == "" {
 		return errors.New("非法路径")
 	}
 
-	err := os.MkdirAll(filepath.Dir(targetFilePath), 0755)
+	//先完整写到 staging 再替换，读者只会看到旧版本或完整的新版本
+	stagingName := path.Join(p.srv.stagingDir, uuid.NewString())
+	hash := sha256.New()
+	var size byteCounter
+	err := p.srv.storage.WriteFile(stagingName, io.TeeReader(rd, io.MultiWriter(hash, &size)))
 	if err != nil {
+		p.srv.storage.Remove(stagingName)
 		return err
 	}
 
-	targetFile, err := os.OpenFile(targetFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if keep := p.KeepVersions(); keep > 0 {
+		err = p.archive(keep)
+		if err != nil {
+			p.srv.storage.Remove(stagingName)
+			return err
+		}
+	}
+
+	var oldSize, newFiles int64 = 0, 1
+	if info, err := p.srv.storage.Stat(targetName); err == nil && !info.IsDir() {
+		oldSize, newFiles = info.Size(), 0
+	}
+
+	err = p.srv.storage.Rename(stagingName, targetName)
 	if err != nil {
+		p.srv.storage.Remove(stagingName)
 		return err
 	}
-	defer targetFile.Close()
+	p.srv.usage.Apply(p.Path(), int64(size)-oldSize, newFiles)
+	p.srv.metrics.bytesWritten.Add(float64(size))
 
-	_, err = io.Copy(targetFile, rd)
-	return err
+	etag := quoteETag(hash.Sum(nil))
+	rememberETag(p, etag)
+	p.srv.changes.Publish(changeEvent{Path: p.Path(), Op: ChangeUpdate, ETag: etag})
+	return nil
 }
 
 func (p *pathMeta) WriteKey() (string, bool) {
 	return p.GetText(MetaWriteKey, true)
 }
 
+// WriteKeySource 生效的 key 及其设置在哪一级路径，用于审计
+func (p *pathMeta) WriteKeySource() (key string, level string, ok bool) {
+	data, level, ok := p.getWithSource(MetaWriteKey, true)
+	return string(data), level, ok
+}
+
 func (p *pathMeta) SetWriteKey(newKey string) error {
 	return p.Set(MetaWriteKey, []byte(newKey))
 }
@@ -89,8 +228,7 @@ func (p *pathMeta) SetWriteKey(newKey string) error {
 func (p *pathMeta) GetBasicAuth() map[string]string {
 	auth, ok := p.Get(MetaReadAuth, true)
 	if ok {
-		var result map[string]string
-		err := json.Unmarshal(auth, &result)
+		result, err := parseBasicAuth(auth)
 		if err == nil {
 			return result
 		}
@@ -98,8 +236,17 @@ func (p *pathMeta) GetBasicAuth() map[string]string {
 	return nil
 }
 
+// SetBasicAuth 保存 basic_auth，明文密码会先转为 bcrypt 哈希
 func (p *pathMeta) SetBasicAuth(in map[string]string) error {
-	bin, err := json.MarshalIndent(in, "", "    ")
+	users := make(map[string]string, len(in))
+	for k, v := range in {
+		users[k] = v
+	}
+	if _, err := hashPlainPasswords(users); err != nil {
+		return err
+	}
+
+	bin, err := json.MarshalIndent(users, "", "    ")
 	if err != nil {
 		return err
 	}
@@ -108,17 +255,50 @@ func (p *pathMeta) SetBasicAuth(in map[string]string) error {
 
 func (p *pathMeta) GetIPChecker() func(ip string) bool {
 	auth, ok := p.Get(MetaIPCheck, true)
-	if ok {
-		var result []string
-		err := json.Unmarshal(auth, &result)
-		if err == nil {
-			checker := svrkit.InSliceChecker(result)
-			return func(ip string) bool {
-				return checker(ip)
-			}
+	if !ok {
+		return nil
+	}
+
+	rules, legacy, err := parseIPRules(auth)
+	if err != nil {
+		return nil
+	}
+	allowAll := rules.AllowAll(legacy)
+
+	var groups map[string][]string
+	if bin, ok := p.Get(MetaIPGroups, true); ok {
+		json.Unmarshal(bin, &groups)
+	}
+
+	allow, allowErr := parseIPEntries(rules.Allow, groups)
+	deny, denyErr := parseIPEntries(rules.Deny, groups)
+	if allowErr != nil || denyErr != nil { //配置有误时全部拒绝
+		return func(ip string) bool { return false }
+	}
+
+	return func(ip string) bool {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || deny.Contains(parsed) {
+			return false
 		}
+		return allowAll || allow.Contains(parsed)
+	}
+}
+
+// GetClientCertChecker 要求 mTLS 客户端证书主题匹配 client_cert 中的条目，没有设置时返回 nil
+func (p *pathMeta) GetClientCertChecker() func(state *tls.ConnectionState) bool {
+	bin, ok := p.Get(MetaClientCert, true)
+	if !ok {
+		return nil
+	}
+
+	subjects, err := parseClientCertRules(bin)
+	if err != nil { //配置有误时全部拒绝
+		return func(state *tls.ConnectionState) bool { return false }
+	}
+	return func(state *tls.ConnectionState) bool {
+		return matchClientCert(state, subjects)
 	}
-	return nil
 }
 
 func (p *pathMeta) GetText(k MetaKey, inherit bool) (string, bool) {
@@ -130,46 +310,115 @@ func (p *pathMeta) GetText(k MetaKey, inherit bool) (string, bool) {
 }
 
 func (p *pathMeta) Get(k MetaKey, inherit bool) ([]byte, bool) {
+	data, _, ok := p.getWithSource(k, inherit)
+	return data, ok
+}
+
+// getWithSource 同 Get，另外返回值所在的路径
+func (p *pathMeta) getWithSource(k MetaKey, inherit bool) ([]byte, string, bool) {
 	if !p.Valid() {
-		return nil, false
+		return nil, "", false
 	}
-	dir := p.metaAbsPath
-	for strings.HasPrefix(dir, p.root) {
-		keyPath := filepath.Join(dir, string(k))
-		data, err := os.ReadFile(keyPath)
+	dir := p.metaName
+	for {
+		data, err := readStorageFile(p.srv.storage, path.Join(dir, string(k)))
 		if err == nil {
-			return data, true
+			return data, path.Clean("/" + strings.TrimPrefix(dir, p.root)), true
 		}
-		if !inherit {
+		if !inherit || dir == p.root {
 			break
 		}
-		dir = filepath.Dir(dir)
+		dir = path.Dir(dir)
 	}
 
-	return nil, false
+	return nil, "", false
 }
 
 func (p *pathMeta) Set(k MetaKey, content []byte) error {
 	if !p.Valid() {
 		return errors.New("invalid meta")
 	}
-	err := os.MkdirAll(p.metaAbsPath, 0755)
+	err := p.srv.storage.WriteFile(path.Join(p.metaName, string(k)), bytes.NewReader(content))
+	if err == nil && k == MetaExpiresAt {
+		p.srv.expiries.Track(p.Path(), p.ExpiresAt())
+	}
+	return err
+}
+
+// Parent 上级路径的 meta，根路径返回自身
+func (p *pathMeta) Parent() *pathMeta {
+	if !p.Valid() || p.metaName == p.root {
+		return p
+	}
+	return p.srv.MetaOf(path.Dir(p.Path()))
+}
+
+// Own 本路径自身设置的 meta key 列表，不含继承的
+func (p *pathMeta) Own() []MetaKey {
+	if !p.Valid() {
+		return nil
+	}
+	entries, err := p.srv.storage.ReadDir(p.metaName)
 	if err != nil {
-		return err
+		return nil
 	}
-	return os.WriteFile(filepath.Join(p.metaAbsPath, string(k)), content, 0644)
+
+	var result []MetaKey
+	for _, e := range entries {
+		if k := MetaKey(e.Name()); !e.IsDir() && k.Valid() {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+func (p *pathMeta) Del(k MetaKey) error {
+	if !p.Valid() {
+		return errors.New("invalid meta")
+	}
+	err := p.srv.storage.Remove(path.Join(p.metaName, string(k)))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err == nil && k == MetaExpiresAt {
+		p.srv.expiries.Track(p.Path(), time.Time{})
+	}
+	return err
 }
 
 func (p *pathMeta) Destroy() error {
-	err := os.RemoveAll(p.metaAbsPath)
+	err := p.srv.storage.RemoveAll(p.metaName)
 	if err != nil {
 		return err
 	}
 
-	err = os.Remove(p.ContentPath())
-	if os.IsNotExist(err) {
+	err = p.srv.storage.RemoveAll(p.versionDir())
+	if err != nil {
+		return err
+	}
+
+	return p.removeContent()
+}
+
+// removeContent 删除内容文件，更新占用并通知订阅者
+func (p *pathMeta) removeContent() error {
+	info, err := p.StatContent()
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
 
+	err = p.srv.storage.Remove(p.ContentName())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err == nil {
+		if !info.IsDir() {
+			p.srv.usage.Apply(p.Path(), -info.Size(), -1)
+		}
+		p.srv.changes.Publish(changeEvent{Path: p.Path(), Op: ChangeDelete})
+	}
 	return err
 }
@@ -1,32 +1,66 @@
 package main
 
-import "testing"
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
 
 func Test_pathMeta(t *testing.T) {
-	k1, _ := MetaOf("/").WriteKey()
-	k2, _ := MetaOf("/some/not/exist").WriteKey()
+	k1, _ := testServer.MetaOf("/").WriteKey()
+	k2, _ := testServer.MetaOf("/some/not/exist").WriteKey()
 	if k1 != k2 {
 		t.Error("not inherit key from parent")
 	}
 
-	_, ok := MetaOf("../../../some/not/exist").WriteKey()
+	_, ok := testServer.MetaOf("../../../some/not/exist").WriteKey()
 	if ok {
 		t.Error("path travel out of root")
 	}
 
-	if MetaOf("/some/sub/item").SetWriteKey("123") != nil {
+	if testServer.MetaOf("/some/sub/item").SetWriteKey("123") != nil {
 		t.Error("set key err")
 	}
 
-	if k3, _ := MetaOf("/some/sub/item").WriteKey(); k3 != "123" {
+	if k3, _ := testServer.MetaOf("/some/sub/item").WriteKey(); k3 != "123" {
 		t.Error("key not match")
 	}
 
-	if MetaOf("/some/sub/item/key").SetWriteKey("678") == nil {
+	if testServer.MetaOf("/some/sub/item/key").SetWriteKey("678") == nil {
 		t.Error("write sub item key of existed item")
 	}
 
-	if err := MetaOf("/some/sub/item").Destroy(); err != nil {
+	if err := testServer.MetaOf("/some/sub/item").Destroy(); err != nil {
 		t.Error("destroy err", err)
 	}
 }
+
+func Test_pathMeta_SaveContentAtomic(t *testing.T) {
+	p := testServer.MetaOf("/atomic_test/file")
+	defer testServer.MetaOf("/atomic_test").Destroy()
+
+	if err := p.SaveContent(strings.NewReader("v1")); err != nil {
+		t.Fatal("save err", err)
+	}
+
+	if err := p.SaveContent(iotest.ErrReader(errors.New("network broken"))); err == nil {
+		t.Error("failed upload not reported")
+	}
+
+	if content := readContent(p); content != "v1" {
+		t.Error("failed upload destroyed old content:", content)
+	}
+
+	entries, _ := testServer.storage.ReadDir(path.Dir(p.ContentName()))
+	staging, _ := testServer.storage.ReadDir(testServer.stagingDir)
+	if len(entries) != 1 || len(staging) != 0 {
+		t.Error("temp file left behind:", entries, staging)
+	}
+}
+
+func readContent(p *pathMeta) string {
+	bin, _ := readStorageFile(testServer.storage, p.ContentName())
+	return string(bin)
+}
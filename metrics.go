@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+// counterVec 带标签的计数器，按 Prometheus 文本格式输出
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.values[""] = 0 //无标签的计数器从 0 开始输出
+	}
+	return c
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitKey(key), "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec 带标签的直方图
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 //与 buckets 一一对应，非累计
+	count  uint64
+	sum    float64
+}
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		hist, labelValues := h.values[key], splitKey(key)
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, labelValues, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, labelValues, "", ""), hist.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, name := range names {
+		if i < len(values) {
+			parts = append(parts, name+`="`+labelEscaper.Replace(values[i])+`"`)
+		}
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// serverMetrics 一个服务实例的指标
+type serverMetrics struct {
+	requests     *counterVec
+	duration     *histogramVec
+	authFailures *counterVec
+	bytesWritten *counterVec
+	bytesServed  *counterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:     newCounterVec("faas_http_requests_total", "HTTP requests by method and status code.", "method", "code"),
+		duration:     newHistogramVec("faas_http_request_duration_seconds", "HTTP request latency.", defaultBuckets, "method"),
+		authFailures: newCounterVec("faas_auth_failures_total", "Rejected requests by auth type and reason.", "type", "reason"),
+		bytesWritten: newCounterVec("faas_bytes_written_total", "Content bytes saved to storage."),
+		bytesServed:  newCounterVec("faas_bytes_served_total", "Response body bytes sent for GET requests."),
+	}
+}
+
+// signFailReason 签名失败原因对应的指标标签
+func signFailReason(err error) string {
+	switch {
+	case errors.Is(err, tool.ErrSignMissing):
+		return "missing"
+	case errors.Is(err, tool.ErrSignLegacyDisabled):
+		return "legacy_disabled"
+	case errors.Is(err, tool.ErrSignMalformed):
+		return "malformed"
+	case errors.Is(err, tool.ErrSignExpired):
+		return "expired"
+	case errors.Is(err, tool.ErrSignMismatch):
+		return "mismatch"
+	case errors.Is(err, tool.ErrSignReplayed):
+		return "replayed"
+	}
+	return "other"
+}
+
+// checkSign 校验写操作签名，依次尝试 keys，都失败时计入指标
+func (s *server) checkSign(r *svrkit.Request, keys ...string) bool {
+	return s.matchSign(r, keys...) >= 0
+}
+
+// matchSign 同 checkSign，返回签名所用 key 的下标，失败时返回 -1
+func (s *server) matchSign(r *svrkit.Request, keys ...string) int {
+	err := tool.ErrSignMismatch
+	i := 0
+	for ; i < len(keys); i++ {
+		if err = s.signer.CheckSign(keys[i], r.Request); !errors.Is(err, tool.ErrSignMismatch) {
+			break
+		}
+	}
+	if err != nil {
+		s.metrics.authFailures.Inc("sign", signFailReason(err))
+		return -1
+	}
+	return i
+}
+
+// metricsRecorder 记录响应状态码和字节数，保留 Flush 以支持 SSE
+type metricsRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (m *metricsRecorder) WriteHeader(code int) {
+	if m.status == 0 {
+		m.status = code
+	}
+	m.ResponseWriter.WriteHeader(code)
+}
+
+func (m *metricsRecorder) Write(p []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	n, err := m.ResponseWriter.Write(p)
+	m.bytes += int64(n)
+	return n, err
+}
+
+func (m *metricsRecorder) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentHandler 统计请求数、耗时和输出字节数，并写访问日志
+func (s *server) instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &metricsRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method := r.Method
+		switch method {
+		case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		default:
+			method = "OTHER" //避免任意 method 撑爆标签
+		}
+		s.metrics.requests.Inc(method, strconv.Itoa(rec.status))
+		s.metrics.duration.Observe(time.Since(start).Seconds(), method)
+		if method == "GET" {
+			s.metrics.bytesServed.Add(float64(rec.bytes))
+		}
+		s.writeAccessLog(r, rec.status, rec.bytes, time.Since(start))
+	})
+}
+
+// metricsAllowed 持有 root key（Authorization: Bearer）或来自 metrics_allow_ips 的请求才能读取指标
+func (s *server) metricsAllowed(r *svrkit.Request) bool {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		rootKeys, _, _ := s.MetaOf("/").WriteKeys()
+		for _, rootKey := range rootKeys {
+			if rootKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(rootKey)) == 1 {
+				return true
+			}
+		}
+	}
+
+	allowed, err := parseIPEntries(s.conf.MetricsAllowIPs, nil)
+	if err != nil || len(allowed) == 0 {
+		return false
+	}
+	ip := net.ParseIP(s.clientIP(r))
+	return ip != nil && allowed.Contains(ip)
+}
+
+func (s *server) metricsHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+	if !s.metricsAllowed(r) {
+		s.metrics.authFailures.Inc("metrics", "denied")
+		rw.HTTPError(http.StatusForbidden, "forbidden")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.requests.writeTo(rw)
+	s.metrics.duration.writeTo(rw)
+	s.metrics.authFailures.writeTo(rw)
+	s.metrics.bytesWritten.writeTo(rw)
+	s.metrics.bytesServed.writeTo(rw)
+
+	if stat, err := s.usage.Get("/"); err == nil {
+		writeGauge(rw, "faas_storage_bytes", "Bytes of current content in storage.", float64(stat.Bytes))
+		writeGauge(rw, "faas_storage_files", "Number of content files in storage.", float64(stat.Files))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	svr := httptest.NewServer(testServer)
+	defer svr.Close()
+
+	resp, _ := http.Get(svr.URL + "/metrics_test_missing")
+	resp.Body.Close()
+	req, _ := http.NewRequest("PUT", svr.URL+"/metrics_test", strings.NewReader("x"))
+	req.SetBasicAuth("0", "bad sign")
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+
+	resp, _ = http.Get(svr.URL + "/metrics")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("metrics readable without root key:", resp.StatusCode)
+	}
+
+	rootKey, _ := testServer.MetaOf("/").WriteKey()
+	req, _ = http.NewRequest("GET", svr.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+rootKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	body := string(bin)
+	for _, want := range []string{
+		`faas_http_requests_total{method="GET",code="404"}`,
+		`faas_http_request_duration_seconds_bucket{method="PUT",le="+Inf"}`,
+		`faas_auth_failures_total{type="sign",reason="mismatch"}`,
+		`faas_auth_failures_total{type="metrics",reason="denied"}`,
+		"faas_bytes_served_total ",
+		"faas_storage_files ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Error("metric missing:", want)
+		}
+	}
+
+	testServer.conf.MetricsAllowIPs = []string{"127.0.0.1"}
+	defer func() { testServer.conf.MetricsAllowIPs = nil }()
+	resp, _ = http.Get(svr.URL + "/metrics")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("allowed ip rejected:", resp.StatusCode)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	dummyHashOnce sync.Once
+	dummyHashBin  []byte
+)
+
+// dummyHash 用户不存在时也做一次 bcrypt 比较，避免按耗时枚举用户名，第一次用到时才生成
+func dummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHashBin, _ = bcrypt.GenerateFromPassword([]byte("faas-dummy-password"), bcrypt.DefaultCost)
+	})
+	return dummyHashBin
+}
+
+const (
+	verifiedCacheTTL = time.Minute
+	verifiedCacheMax = 4096
+)
+
+// passwordCache 最近校验通过的 (用户, 哈希, 密码)，轮询和 watch 客户端每个请求都带 basic auth，
+// 避免每次都算一遍 bcrypt。只记随机 key 的 HMAC，不保存可离线破解的密码摘要；
+// 哈希变化（改密码、删用户）后自然失效
+type passwordCache struct {
+	lock    sync.Mutex
+	secret  []byte
+	entries map[string]time.Time
+}
+
+func newPasswordCache() *passwordCache {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &passwordCache{secret: secret, entries: make(map[string]time.Time)}
+}
+
+func (c *passwordCache) key(user, stored, pass string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(mac, "%s\x00%s\x00%s", user, stored, pass)
+	return string(mac.Sum(nil))
+}
+
+func (c *passwordCache) Has(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires, ok := c.entries[key]
+	return ok && time.Now().Before(expires)
+}
+
+func (c *passwordCache) Add(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.entries) >= verifiedCacheMax {
+		for k, expires := range c.entries {
+			if !now.Before(expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= verifiedCacheMax {
+			c.entries = make(map[string]time.Time)
+		}
+	}
+	c.entries[key] = now.Add(verifiedCacheTTL)
+}
+
+// isHashedPassword 是否 htpasswd 兼容的哈希格式
+func isHashedPassword(s string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$argon2id$", "$argon2i$", "{SHA}"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashPassword 新密码统一用 bcrypt 存储
+func hashPassword(pass string) (string, error) {
+	bin, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	return string(bin), err
+}
+
+// verifyPassword 校验密码，stored 可以是哈希或旧的明文
+func verifyPassword(stored, pass string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass)) == nil
+	case strings.HasPrefix(stored, "$5$"):
+		computed, ok := sha256Crypt(pass, stored)
+		return ok && subtle.ConstantTimeCompare([]byte(computed), []byte(stored)) == 1
+	case strings.HasPrefix(stored, "$argon2"):
+		return verifyArgon2(stored, pass)
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		computed := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(stored)) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1
+}
+
+// checkBasicAuth 校验用户名密码，用户不存在时耗时与存在时一致
+func (s *server) checkBasicAuth(users map[string]string, user, pass string) bool {
+	stored, ok := users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(pass))
+		return false
+	}
+	key := s.passwords.key(user, stored, pass)
+	if s.passwords.Has(key) {
+		return true
+	}
+	if !verifyPassword(stored, pass) {
+		return false
+	}
+	s.passwords.Add(key)
+	return true
+}
+
+// parseBasicAuth 解析 basic_auth，支持 json 对象和 htpasswd 文本两种格式
+func parseBasicAuth(content []byte) (map[string]string, error) {
+	var result map[string]string
+	if err := json.Unmarshal(content, &result); err == nil {
+		return result, nil
+	}
+
+	result = make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || !isHashedPassword(hash) {
+			return nil, fmt.Errorf("bad htpasswd line: %q", line)
+		}
+		result[user] = hash
+	}
+	return result, s.Err()
+}
+
+// hashPlainPasswords 把明文密码替换为 bcrypt 哈希，返回是否有改动
+func hashPlainPasswords(users map[string]string) (bool, error) {
+	changed := false
+	for user, pass := range users {
+		if isHashedPassword(pass) {
+			continue
+		}
+		hash, err := hashPassword(pass)
+		if err != nil {
+			return changed, err
+		}
+		users[user] = hash
+		changed = true
+	}
+	return changed, nil
+}
+
+// verifyArgon2 格式 $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func verifyArgon2(stored, pass string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	var computed []byte
+	if parts[1] == "argon2id" {
+		computed = argon2.IDKey([]byte(pass), salt, time, memory, threads, uint32(len(hash)))
+	} else {
+		computed = argon2.Key([]byte(pass), salt, time, memory, threads, uint32(len(hash)))
+	}
+	return subtle.ConstantTimeCompare(computed, hash) == 1
+}
+
+const cryptB64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha256Crypt 实现 glibc SHA-256-crypt ($5$)，返回与 setting 同格式的完整哈希
+func sha256Crypt(pass, setting string) (string, bool) {
+	rest := strings.TrimPrefix(setting, "$5$")
+	rounds, customRounds := 5000, false
+	if strings.HasPrefix(rest, "rounds=") {
+		n, after, ok := strings.Cut(strings.TrimPrefix(rest, "rounds="), "$")
+		if !ok {
+			return "", false
+		}
+		r, err := strconv.Atoi(n)
+		if err != nil {
+			return "", false
+		}
+		rounds, customRounds, rest = r, true, after
+		if rounds < 1000 {
+			rounds = 1000
+		} else if rounds > 999999999 {
+			rounds = 999999999
+		}
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	p, s := []byte(pass), []byte(salt)
+
+	h := sha256.New()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	for i := len(p); i > 0; i -= 32 {
+		h.Write(b[:minInt(i, 32)])
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	dp := h.Sum(nil)
+	pSeq := make([]byte, 0, len(p))
+	for i := len(p); i > 0; i -= 32 {
+		pSeq = append(pSeq, dp[:minInt(i, 32)]...)
+	}
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	ds := h.Sum(nil)
+	sSeq := make([]byte, 0, len(s))
+	for i := len(s); i > 0; i -= 32 {
+		sSeq = append(sSeq, ds[:minInt(i, 32)]...)
+	}
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$5$")
+	if customRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt + "$")
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out.WriteByte(cryptB64[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29}} {
+		encode(c[idx[0]], c[idx[1]], c[idx[2]], 4)
+	}
+	encode(0, c[31], c[30], 3)
+	return out.String(), true
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// migrateBasicAuth 遍历 meta 目录，把所有 basic_auth 中的明文密码转为哈希
+func (s *server) migrateBasicAuth() (int, error) {
+	migrated := 0
+	err := walkStorage(s.storage, metaSubDir, func(name string, info fs.FileInfo) error {
+		if info.Name() != string(MetaReadAuth) {
+			return nil
+		}
+
+		p := s.MetaOf(strings.TrimPrefix(path.Dir(name), metaSubDir))
+		users, ok := p.Get(MetaReadAuth, false)
+		if !ok {
+			return nil
+		}
+		parsed, err := parseBasicAuth(users)
+		if err != nil {
+			log.Println("skip bad basic_auth:", name, err)
+			return nil
+		}
+
+		changed, err := hashPlainPasswords(parsed)
+		if err != nil || !changed {
+			return err
+		}
+		migrated++
+		return p.SetBasicAuth(parsed)
+	})
+	return migrated, err
+}
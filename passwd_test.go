@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, _ := hashPassword("secret")
+	argonHash := "$argon2id$v=19$m=1024,t=1,p=1$" + base64.RawStdEncoding.EncodeToString([]byte("somesalt")) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), []byte("somesalt"), 1, 1024, 1, 32))
+
+	for _, stored := range []string{
+		bcryptHash,
+		argonHash,
+		"$5$saltstring$C3o4O1TC6aRHF4FI.QSZMXtHbaj2gSXr4sUc/3NcUi.", //openssl passwd -5 -salt saltstring secret
+		"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"secret",
+	} {
+		if !verifyPassword(stored, "secret") {
+			t.Error("good password rejected:", stored)
+		}
+		if verifyPassword(stored, "Secret") {
+			t.Error("bad password accepted:", stored)
+		}
+	}
+}
+
+func TestSHA256Crypt(t *testing.T) {
+	if got, _ := sha256Crypt("Hello world!", "$5$saltstring"); got != "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5" {
+		t.Error("unexpected hash:", got)
+	}
+	if got, _ := sha256Crypt("Hello world!", "$5$rounds=10000$saltstringsaltstring"); got != "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA" {
+		t.Error("unexpected hash with rounds:", got)
+	}
+}
+
+func TestMigrateBasicAuth(t *testing.T) {
+	p := testServer.MetaOf("/migrate_test")
+	p.Set(MetaReadAuth, []byte(`{"user": "pass"}`))
+	defer p.Destroy()
+
+	if _, err := testServer.migrateBasicAuth(); err != nil {
+		t.Fatal("migrate err", err)
+	}
+
+	bin, _ := p.Get(MetaReadAuth, false)
+	if strings.Contains(string(bin), `"pass"`) {
+		t.Error("plaintext password left:", string(bin))
+	}
+	if !testServer.checkBasicAuth(p.GetBasicAuth(), "user", "pass") {
+		t.Error("migrated password rejected")
+	}
+}
+
+func TestParseBasicAuth_Htpasswd(t *testing.T) {
+	users, err := parseBasicAuth([]byte("# comment\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+	if err != nil || !testServer.checkBasicAuth(users, "alice", "secret") {
+		t.Error("htpasswd format not work", err)
+	}
+
+	if _, err := parseBasicAuth([]byte("alice:plain")); err == nil {
+		t.Error("plaintext htpasswd line accepted")
+	}
+}
+
+func TestCheckBasicAuth_Cache(t *testing.T) {
+	hash, _ := hashPassword("pass")
+	users := map[string]string{"user": hash}
+	if !testServer.checkBasicAuth(users, "user", "pass") {
+		t.Fatal("valid password rejected")
+	}
+	if !testServer.passwords.Has(testServer.passwords.key("user", hash, "pass")) {
+		t.Error("verified password not cached")
+	}
+	if testServer.checkBasicAuth(users, "user", "bad") || testServer.checkBasicAuth(users, "nobody", "pass") {
+		t.Error("bad credentials accepted")
+	}
+
+	//改密码后缓存不再生效
+	users["user"], _ = hashPassword("new-pass")
+	if testServer.checkBasicAuth(users, "user", "pass") {
+		t.Error("old password accepted from cache")
+	}
+}
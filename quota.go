@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/horsley/svrkit"
+)
+
+// quotaRules quota 的内容，限制所在目录整个子树的字节数和文件数，0 表示不限制
+type quotaRules struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+func parseQuota(content []byte) (*quotaRules, error) {
+	var q quotaRules
+	if err := json.Unmarshal(content, &q); err != nil {
+		return nil, err
+	}
+	if q.Bytes < 0 || q.Files < 0 {
+		return nil, errors.New("negative quota")
+	}
+	return &q, nil
+}
+
+func parseMaxSize(content []byte) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err == nil && n < 0 {
+		return 0, errors.New("negative max size")
+	}
+	return n, err
+}
+
+// MaxSize 单个文件的大小上限，沿用上级设置，0 表示不限制
+func (p *pathMeta) MaxSize() int64 {
+	bin, ok := p.Get(MetaMaxSize, true)
+	if !ok {
+		return 0
+	}
+	n, _ := parseMaxSize(bin)
+	return n
+}
+
+// Quotas 本路径及各级上级自己设置的配额，子树中的写入要同时满足所有配额
+func (p *pathMeta) Quotas() map[string]*quotaRules {
+	result := make(map[string]*quotaRules)
+	for m := p; ; m = m.Parent() {
+		if bin, ok := m.Get(MetaQuota, false); ok {
+			if q, err := parseQuota(bin); err == nil {
+				result[m.Path()] = q
+			}
+		}
+		if m.Parent() == m {
+			break
+		}
+	}
+	return result
+}
+
+// errQuotaExceeded 子树文件数已满
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// byteCounter 统计写入的字节数
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+type usageStat struct {
+	Bytes int64
+	Files int64
+}
+
+// usageIndex 各前缀下内容占用的缓存，首次查询时遍历存储，之后随写入和删除增量更新。
+// 只统计当前内容，历史版本不计入
+type usageIndex struct {
+	srv   *server
+	lock  sync.Mutex
+	cache map[string]*usageStat
+}
+
+func newUsageIndex() *usageIndex {
+	return &usageIndex{cache: make(map[string]*usageStat)}
+}
+
+// Get 查询前缀（目录或文件）下的占用
+func (u *usageIndex) Get(prefix string) (usageStat, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if stat, ok := u.cache[prefix]; ok {
+		return *stat, nil
+	}
+
+	stat := &usageStat{}
+	name := u.srv.MetaOf(prefix).ContentName()
+	info, err := u.srv.storage.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	} else if err == nil && !info.IsDir() {
+		stat.Bytes, stat.Files = info.Size(), 1
+	} else if err == nil {
+		err = walkStorage(u.srv.storage, name, func(name string, info fs.FileInfo) error {
+			stat.Bytes += info.Size()
+			stat.Files++
+			return nil
+		})
+	}
+	if err != nil {
+		return usageStat{}, err
+	}
+
+	u.cache[prefix] = stat
+	return *stat, nil
+}
+
+// Apply 文件 filePath 的变化计入已缓存的各级前缀
+func (u *usageIndex) Apply(filePath string, bytes, files int64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for prefix, stat := range u.cache {
+		if prefix == "/" || prefix == filePath || strings.HasPrefix(filePath, prefix+"/") {
+			stat.Bytes += bytes
+			stat.Files += files
+		}
+	}
+}
+
+// Invalidate 目录整体被替换后丢弃它自身、上级和下级前缀的缓存，下次查询时重新统计
+func (u *usageIndex) Invalidate(dirPath string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for prefix := range u.cache {
+		if prefix == "/" || prefix == dirPath || strings.HasPrefix(dirPath, prefix+"/") || strings.HasPrefix(prefix, dirPath+"/") {
+			delete(u.cache, prefix)
+		}
+	}
+}
+
+// uploadLimit 上传到 p 最多还能写入的字节数，-1 表示不限制；byQuota 表示限制来自配额。
+// 覆盖已有文件时旧内容的占用会被释放，所以计入可用空间。
+// 并发上传各自检查，可能短暂超出配额
+func uploadLimit(p *pathMeta) (limit int64, byQuota bool, err error) {
+	limit = -1
+	if p.srv.conf.MaxUploadSize > 0 {
+		limit = p.srv.conf.MaxUploadSize
+	}
+	if n := p.MaxSize(); n > 0 && (limit < 0 || n < limit) {
+		limit = n
+	}
+
+	var oldSize, newFiles int64 = 0, 1
+	if info, err := p.StatContent(); err == nil && !info.IsDir() {
+		oldSize, newFiles = info.Size(), 0
+	}
+
+	for prefix, q := range p.Quotas() {
+		used, err := p.srv.usage.Get(prefix)
+		if err != nil {
+			return 0, false, err
+		}
+		if q.Files > 0 && used.Files+newFiles > q.Files {
+			return 0, true, errQuotaExceeded
+		}
+		if q.Bytes > 0 {
+			remain := q.Bytes - used.Bytes + oldSize
+			if remain < 0 {
+				remain = 0
+			}
+			if limit < 0 || remain < limit {
+				limit, byQuota = remain, true
+			}
+		}
+	}
+	return limit, byQuota, nil
+}
+
+type usageReport struct {
+	Path    string
+	Bytes   int64
+	Files   int64
+	MaxSize int64                  `json:",omitempty"`
+	Quotas  map[string]*quotaRules `json:",omitempty"`
+	// Children 目录下各子项的占用
+	Children []usageEntry `json:",omitempty"`
+}
+
+type usageEntry struct {
+	Path  string
+	Bytes int64
+	Files int64
+}
+
+// usageHandler ?usage 查询前缀的占用和生效的限制
+func (s *server) usageHandler(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta) {
+	stat, err := s.usage.Get(targetMeta.Path())
+	if err != nil {
+		rw.HTTPError(http.StatusInternalServerError, "usage fail")
+		return
+	}
+	report := usageReport{
+		Path:    targetMeta.Path(),
+		Bytes:   stat.Bytes,
+		Files:   stat.Files,
+		MaxSize: targetMeta.MaxSize(),
+		Quotas:  targetMeta.Quotas(),
+	}
+
+	if targetMeta.IsDir() {
+		entries, _ := s.storage.ReadDir(targetMeta.ContentName())
+		for _, info := range entries {
+			childPath := path.Join(report.Path, info.Name())
+			child, err := s.usage.Get(childPath)
+			if err != nil {
+				rw.HTTPError(http.StatusInternalServerError, "usage fail")
+				return
+			}
+			report.Children = append(report.Children, usageEntry{childPath, child.Bytes, child.Files})
+		}
+	}
+	rw.WriteCommonResponse(0, "", report)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+func signedRequest(method, target, body string) string {
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ := http.NewRequest(method, "http://abc.com"+target, strings.NewReader(body))
+	tool.SignUpload(peekRootKey, mockReq)
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	return rec.Body.String()
+}
+
+func TestMaxSize(t *testing.T) {
+	testServer.MetaOf("/max_size_test").Set(MetaMaxSize, []byte("5"))
+	defer testServer.MetaOf("/max_size_test").Destroy()
+	defer testServer.MetaOf("/max_size_test/sub/a").Destroy()
+
+	if resp := signedRequest("PUT", "/max_size_test/sub/a", "123456"); resp != `{"Code":413,"Data":null,"Message":"文件过大"}` {
+		t.Error("oversize upload accepted:", resp)
+	}
+	if resp := signedRequest("PUT", "/max_size_test/sub/a", "12345"); resp != `{"Code":0,"Data":null,"Message":""}` {
+		t.Error("upload within limit rejected:", resp)
+	}
+
+	if MetaMaxSize.Validate([]byte("-1")) == nil || MetaQuota.Validate([]byte(`{"bytes": -1}`)) == nil {
+		t.Error("negative limit accepted")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	testServer.MetaOf("/quota_test").Set(MetaQuota, []byte(`{"bytes": 10, "files": 2}`))
+	defer testServer.MetaOf("/quota_test").Destroy()
+	defer testServer.MetaOf("/quota_test/a").Destroy()
+	defer testServer.MetaOf("/quota_test/sub/b").Destroy()
+
+	const ok = `{"Code":0,"Data":null,"Message":""}`
+	const exceeded = `{"Code":507,"Data":null,"Message":"超出配额"}`
+	for i, c := range []struct {
+		target, body, want string
+	}{
+		{"/quota_test/a", "123456", ok},
+		{"/quota_test/sub/b", "123456", exceeded},
+		{"/quota_test/sub/b", "1234", ok},
+		{"/quota_test/c", "", exceeded},        //文件数已满
+		{"/quota_test/a", "abcdef", ok},        //覆盖时旧内容的占用可复用
+		{"/quota_test/a", "abcdefg", exceeded}, //但不能超过剩余空间
+	} {
+		if resp := signedRequest("PUT", c.target, c.body); resp != c.want {
+			t.Error(i, "unexpected result:", resp)
+		}
+	}
+
+	getUsage := func() usageReport {
+		mockReq, _ := http.NewRequest("GET", "http://abc.com/quota_test?usage", nil)
+		rec := httptest.NewRecorder()
+		testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+		var resp struct {
+			Data usageReport
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Data
+	}
+	report := getUsage()
+	if report.Bytes != 10 || report.Files != 2 || len(report.Children) != 2 || report.Quotas["/quota_test"].Bytes != 10 {
+		t.Errorf("unexpected usage: %+v", report)
+	}
+
+	if resp := signedRequest("DELETE", "/quota_test/a", ""); resp != ok {
+		t.Error("delete fail:", resp)
+	}
+	if report := getUsage(); report.Bytes != 4 || report.Files != 1 {
+		t.Errorf("usage not updated after delete: %+v", report)
+	}
+}
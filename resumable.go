@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+// uploadsSubDir 断点续传会话的存储目录，和 staging 分开，重启后会话仍可继续
+const uploadsSubDir = "uploads"
+
+// uploadSessionTTL 会话创建后多久未提交视为放弃
+const uploadSessionTTL = 24 * time.Hour
+
+const uploadSessionInfo = "info"
+
+// uploadSession 断点续传会话，已接收的分片按偏移量存为独立文件，提交时按顺序拼接
+type uploadSession struct {
+	ID      string
+	Path    string
+	Offset  int64
+	Length  int64 `json:",omitempty"` //客户端声明的总大小，0 表示未知
+	Created time.Time
+}
+
+func uploadSessionDir(id string) string {
+	return path.Join(uploadsSubDir, id)
+}
+
+func chunkName(id string, offset int64) string {
+	return path.Join(uploadSessionDir(id), fmt.Sprintf("%020d", offset))
+}
+
+// loadUploadSession 读取会话信息，偏移量由已保存的分片计算
+func (s *server) loadUploadSession(id string) (*uploadSession, []string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, nil, fs.ErrNotExist
+	}
+	bin, err := readStorageFile(s.storage, path.Join(uploadSessionDir(id), uploadSessionInfo))
+	if err != nil {
+		return nil, nil, err
+	}
+	var session uploadSession
+	if err := json.Unmarshal(bin, &session); err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := s.storage.ReadDir(uploadSessionDir(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	var chunks []string
+	for _, info := range entries { //ReadDir 按名字排序，即按偏移量排序
+		if info.Name() == uploadSessionInfo || info.IsDir() {
+			continue
+		}
+		chunks = append(chunks, path.Join(uploadSessionDir(id), info.Name()))
+		session.Offset += info.Size()
+	}
+	return &session, chunks, nil
+}
+
+// sweepUploadSessions 删除过期的会话
+func (s *server) sweepUploadSessions() {
+	entries, err := s.storage.ReadDir(uploadsSubDir)
+	if err != nil {
+		return
+	}
+	for _, info := range entries {
+		session, _, err := s.loadUploadSession(info.Name())
+		if err != nil || time.Since(session.Created) > uploadSessionTTL {
+			s.storage.RemoveAll(uploadSessionDir(info.Name()))
+		}
+	}
+}
+
+// chunkReader 按顺序读出所有分片
+type chunkReader struct {
+	st    Storage
+	names []string
+	cur   File
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.names) == 0 {
+				return 0, io.EOF
+			}
+			f, err := c.st.Open(c.names[0])
+			if err != nil {
+				return 0, err
+			}
+			c.cur, c.names = f, c.names[1:]
+		}
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur != nil {
+		return c.cur.Close()
+	}
+	return nil
+}
+
+// resumableHandler 断点续传，都需要目标路径的 key 或有 upload 权限的命名 key 签名：
+//
+//	POST   /path?uploads                      创建会话，可带 Upload-Length
+//	GET    /path?upload=<id>                  查询已接收的偏移量
+//	PATCH  /path?upload=<id>  Upload-Offset   追加分片，偏移量必须等于已接收的大小
+//	POST   /path?upload=<id>&commit           提交，内容原子地替换目标，支持 If-Match、X-TTL 和 X-Expires-At
+//	DELETE /path?upload=<id>                  放弃
+func (s *server) resumableHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+	targetMeta := s.MetaOf(r.URL.Path)
+	auth, err := s.authorize(r, targetMeta, ScopeUpload)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Has("uploads") {
+		if r.Method != "POST" {
+			rw.HTTPError(http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		s.createUploadSession(rw, r, targetMeta)
+		return
+	}
+
+	id := q.Get("upload")
+	unlock := s.pathLocks.Lock(uploadSessionDir(id))
+	defer unlock()
+
+	session, chunks, err := s.loadUploadSession(id)
+	if err != nil || session.Path != targetMeta.Path() {
+		rw.WriteCommonResponse(404, "上传会话不存在", nil)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" || r.Method == "HEAD":
+		rw.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		rw.WriteCommonResponse(0, "", session)
+	case r.Method == "PATCH":
+		s.appendUploadChunk(rw, r, targetMeta, session)
+	case r.Method == "POST" && q.Has("commit"):
+		entry := s.newAuditEntry(r, targetMeta, auth, false)
+		entry.Op = AuditUpload
+		s.commitUploadSession(rw, r, targetMeta, session, chunks, entry)
+	case r.Method == "DELETE":
+		if err := s.storage.RemoveAll(uploadSessionDir(id)); err != nil {
+			log.Println("Remove upload session err:", err, id)
+			rw.WriteCommonResponse(500, "删除失败", nil)
+			return
+		}
+		rw.WriteCommonResponse(0, "", nil)
+	default:
+		rw.HTTPError(http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *server) createUploadSession(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta) {
+	if targetMeta.IsDir() {
+		rw.WriteCommonResponse(403, "非法目标", nil)
+		return
+	}
+	s.sweepUploadSessions()
+
+	session := &uploadSession{ID: uuid.NewString(), Path: targetMeta.Path(), Created: time.Now()}
+	if v := r.Header.Get("Upload-Length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			rw.WriteCommonResponse(400, "Upload-Length 格式错误", nil)
+			return
+		}
+		session.Length = n
+	}
+
+	limit, byQuota, err := uploadLimit(targetMeta)
+	if errors.Is(err, errQuotaExceeded) || (byQuota && limit >= 0 && session.Length > limit) {
+		rw.WriteCommonResponse(507, "超出配额", nil)
+		return
+	}
+	if err != nil {
+		log.Println("uploadLimit err:", err, targetMeta.Path())
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+	if limit >= 0 && session.Length > limit {
+		rw.WriteCommonResponse(413, "文件过大", nil)
+		return
+	}
+
+	bin, _ := json.Marshal(session)
+	err = s.storage.WriteFile(path.Join(uploadSessionDir(session.ID), uploadSessionInfo), strings.NewReader(string(bin)))
+	if err != nil {
+		log.Println("Create upload session err:", err, targetMeta.Path())
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+	rw.Header().Set("Upload-Offset", "0")
+	rw.WriteCommonResponse(0, "", session)
+}
+
+func (s *server) appendUploadChunk(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta, session *uploadSession) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != session.Offset { //只能从已接收的位置继续
+		rw.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		rw.WriteCommonResponse(409, "偏移量不匹配", session)
+		return
+	}
+
+	var body io.Reader = r.Body
+	limit, byQuota, err := uploadLimit(targetMeta)
+	if errors.Is(err, errQuotaExceeded) {
+		rw.WriteCommonResponse(507, "超出配额", nil)
+		return
+	}
+	if err != nil {
+		log.Println("uploadLimit err:", err, targetMeta.Path())
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+	if session.Length > 0 && (limit < 0 || session.Length < limit) {
+		limit, byQuota = session.Length, false
+	}
+	if limit >= 0 {
+		remain := limit - offset
+		if remain < 0 {
+			remain = 0
+		}
+		body = http.MaxBytesReader(rw, io.NopCloser(body), remain)
+	}
+
+	//分片写入是原子的，中途断开不会留下半个分片，客户端从上一个分片结尾重传
+	err = s.storage.WriteFile(chunkName(session.ID, offset), body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, tool.ErrContentHashMismatch):
+		rw.WriteCommonResponse(400, "内容校验失败", nil)
+		return
+	case errors.As(err, &tooLarge) && byQuota:
+		rw.WriteCommonResponse(507, "超出配额", nil)
+		return
+	case errors.As(err, &tooLarge):
+		rw.WriteCommonResponse(413, "文件过大", nil)
+		return
+	case err != nil:
+		log.Println("Append upload chunk err:", err, targetMeta.Path())
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+
+	session, _, err = s.loadUploadSession(session.ID)
+	if err != nil {
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	rw.WriteCommonResponse(0, "", session)
+}
+
+func (s *server) commitUploadSession(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta, session *uploadSession, chunks []string, entry auditEntry) {
+	if session.Length > 0 && session.Offset != session.Length {
+		rw.WriteCommonResponse(409, "上传未完成", session)
+		return
+	}
+
+	unlock := s.pathLocks.Lock(targetMeta.Path())
+	defer unlock()
+	if ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match"); ifMatch != "" || ifNoneMatch != "" {
+		if !checkPreconditions(targetMeta, ifMatch, ifNoneMatch) {
+			rw.WriteCommonResponse(412, "前置条件不满足", nil)
+			return
+		}
+	}
+
+	expiresAt, err := uploadExpiry(r, targetMeta)
+	if err != nil {
+		rw.WriteCommonResponse(400, "过期时间格式错误", nil)
+		return
+	}
+
+	//配额可能在上传期间被其他写入占用，提交时再检查一次
+	limit, byQuota, err := uploadLimit(targetMeta)
+	if errors.Is(err, errQuotaExceeded) {
+		rw.WriteCommonResponse(507, "超出配额", nil)
+		return
+	}
+	if err != nil {
+		log.Println("uploadLimit err:", err, targetMeta.Path())
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+	if limit >= 0 && session.Offset > limit && byQuota {
+		rw.WriteCommonResponse(507, "超出配额", nil)
+		return
+	}
+	if limit >= 0 && session.Offset > limit {
+		rw.WriteCommonResponse(413, "文件过大", nil)
+		return
+	}
+
+	content := &chunkReader{st: s.storage, names: chunks}
+	defer content.Close()
+	if err := targetMeta.SaveContent(content); err != nil {
+		log.Println("Commit upload err:", err, targetMeta.Path())
+		rw.WriteCommonResponse(500, "保存失败", nil)
+		return
+	}
+	s.storage.RemoveAll(uploadSessionDir(session.ID))
+	if err := targetMeta.SetExpiry(expiresAt); err != nil {
+		log.Println("SetExpiry err:", err, targetMeta.Path())
+	}
+
+	entry.Size = session.Offset
+	if etag, ok := contentETag(targetMeta); ok {
+		rw.Header().Set("ETag", etag)
+		entry.Hash = strings.Trim(etag, `"`)
+	}
+	s.audit.Record(entry)
+	rw.WriteCommonResponse(0, "", nil)
+}
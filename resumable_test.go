@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+func resumableRequest(t *testing.T, method, target, body string, header map[string]string) (int, uploadSession) {
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ := http.NewRequest(method, "http://abc.com"+target, strings.NewReader(body))
+	for k, v := range header {
+		mockReq.Header.Set(k, v)
+	}
+	if err := tool.SignRequest(peekRootKey, mockReq); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+
+	var resp struct {
+		Code int
+		Data uploadSession
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return resp.Code, resp.Data
+}
+
+func TestResumableUpload(t *testing.T) {
+	p := testServer.MetaOf("/resumable_test")
+	defer p.Destroy()
+
+	code, session := resumableRequest(t, "POST", "/resumable_test?uploads", "", map[string]string{"Upload-Length": "11"})
+	if code != 0 || session.ID == "" {
+		t.Fatal("create session fail:", code)
+	}
+	sessionURL := "/resumable_test?upload=" + session.ID
+
+	if code, s := resumableRequest(t, "PATCH", sessionURL, "hello ", map[string]string{"Upload-Offset": "0"}); code != 0 || s.Offset != 6 {
+		t.Fatal("append fail:", code, s.Offset)
+	}
+	if code, s := resumableRequest(t, "PATCH", sessionURL, "again", map[string]string{"Upload-Offset": "0"}); code != 409 || s.Offset != 6 {
+		t.Error("wrong offset accepted:", code, s.Offset)
+	}
+	if code, _ := resumableRequest(t, "POST", sessionURL+"&commit", "", nil); code != 409 {
+		t.Error("incomplete upload committed:", code)
+	}
+	if code, s := resumableRequest(t, "GET", sessionURL, "", nil); code != 0 || s.Offset != 6 {
+		t.Error("unexpected status:", code, s.Offset)
+	}
+	if _, err := p.StatContent(); err == nil {
+		t.Error("content visible before commit")
+	}
+
+	resumableRequest(t, "PATCH", sessionURL, "world", map[string]string{"Upload-Offset": "6"})
+	if code, _ := resumableRequest(t, "POST", sessionURL+"&commit", "", nil); code != 0 {
+		t.Fatal("commit fail:", code)
+	}
+	if content := readContent(p); content != "hello world" {
+		t.Error("unexpected content:", content)
+	}
+	if code, _ := resumableRequest(t, "GET", sessionURL, "", nil); code != 404 {
+		t.Error("session not removed after commit:", code)
+	}
+}
+
+func TestUploadResumable_Retry(t *testing.T) {
+	defer func(size int64, wait time.Duration) {
+		tool.ResumableChunkSize, tool.ResumableRetryWait = size, wait
+	}(tool.ResumableChunkSize, tool.ResumableRetryWait)
+	tool.ResumableChunkSize = 4
+	tool.ResumableRetryWait = 0
+	defer testServer.MetaOf("/resumable_retry").Destroy()
+
+	var failed int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" && r.Header.Get("Upload-Offset") == "4" && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			http.Error(w, "bad gateway", http.StatusBadGateway) //模拟网络中断
+			return
+		}
+		testServer.ServeHTTP(w, r)
+	}))
+	defer svr.Close()
+
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	content := "0123456789abcdefg"
+	if err := tool.UploadResumable(svr.URL+"/resumable_retry", peekRootKey, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&failed) != 1 {
+		t.Error("failure not injected")
+	}
+	if got := readContent(testServer.MetaOf("/resumable_retry")); got != content {
+		t.Error("unexpected content:", got)
+	}
+}
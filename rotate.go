@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/horsley/svrkit"
+)
+
+var errNoOwnKey = errors.New("path has no own key")
+
+// previousKey 轮换前的 key，到期前和新 key 一样有效
+type previousKey struct {
+	Key     string
+	Expires time.Time
+}
+
+func parsePreviousKey(content []byte) (*previousKey, error) {
+	var prev previousKey
+	if err := json.Unmarshal(content, &prev); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(prev.Key) == "" {
+		return nil, errors.New("empty key")
+	}
+	return &prev, nil
+}
+
+// PreviousKey 本路径轮换前的 key，不在宽限期内时返回 false
+func (p *pathMeta) PreviousKey() (string, bool) {
+	bin, ok := p.Get(MetaPrevKey, false)
+	if !ok {
+		return "", false
+	}
+	prev, err := parsePreviousKey(bin)
+	if err != nil || !time.Now().Before(prev.Expires) {
+		return "", false
+	}
+	return prev.Key, true
+}
+
+// WriteKeys 生效的 key 及其所在路径，轮换宽限期内还包括旧 key
+func (p *pathMeta) WriteKeys() ([]string, string, bool) {
+	key, level, ok := p.WriteKeySource()
+	if !ok {
+		return nil, "", false
+	}
+	keys := []string{key}
+	if prev, ok := p.srv.MetaOf(level).PreviousKey(); ok {
+		keys = append(keys, prev)
+	}
+	return keys, level, true
+}
+
+// RotateKey 把本路径自身的 key 换成 newKey，旧 key 在 grace 内仍然有效，grace 为 0 时立即失效。
+// newKey 为空时生成，返回新 key。key_previous 即使已过期也保留，作为发生过轮换的记录
+func (p *pathMeta) RotateKey(newKey string, grace time.Duration) (string, error) {
+	unlock := p.srv.pathLocks.Lock(path.Join(p.metaName, string(MetaWriteKey)))
+	defer unlock()
+
+	old, ok := p.GetText(MetaWriteKey, false)
+	if !ok {
+		return "", errNoOwnKey
+	}
+	if newKey == "" {
+		newKey = uuid.NewString()
+	}
+	if newKey == old {
+		return "", errors.New("new key is the same as current key")
+	}
+	if err := MetaWriteKey.Validate([]byte(newKey)); err != nil {
+		return "", err
+	}
+
+	//先保存旧 key 再替换，避免中间有新旧 key 都不可用的窗口
+	bin, _ := json.Marshal(previousKey{Key: old, Expires: time.Now().Add(grace)})
+	if err := p.Set(MetaPrevKey, bin); err != nil {
+		return "", err
+	}
+	return newKey, p.SetWriteKey(newKey)
+}
+
+type rotateResult struct {
+	Key             string
+	PreviousExpires time.Time `json:",omitempty"`
+}
+
+// rotateKeyHandler 轮换路径自身的 key，POST /_meta/<path>?rotate&grace=24h，请求体为新 key，为空时生成。
+// 需用该路径当前的 key 签名，宽限期内的旧 key 和命名 key 不能轮换，grace 默认取配置 key_rotation_grace
+func (s *server) rotateKeyHandler(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta, auth keyAuth) {
+	if r.Method != "POST" {
+		rw.HTTPError(405, "method not allowed")
+		return
+	}
+
+	grace := s.conf.KeyRotationGrace
+	if v := r.URL.Query().Get("grace"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			rw.WriteCommonResponse(400, "grace 格式错误", nil)
+			return
+		}
+		grace = d
+	}
+	bin, err := io.ReadAll(r.Body)
+	if err != nil {
+		rw.WriteCommonResponse(400, "读取内容失败", nil)
+		return
+	}
+
+	newKey, err := targetMeta.RotateKey(strings.TrimSpace(string(bin)), grace)
+	if errors.Is(err, errNoOwnKey) {
+		rw.WriteCommonResponse(400, "该路径没有单独设置 key", nil)
+		return
+	}
+	if err != nil {
+		log.Println("Rotate key err:", err, targetMeta.Path())
+		rw.WriteCommonResponse(500, "轮换失败", nil)
+		return
+	}
+
+	entry := s.newAuditEntry(r, targetMeta, auth, false)
+	entry.Op, entry.MetaKey = AuditKeyRotate, MetaWriteKey
+	s.audit.Record(entry)
+
+	result := rotateResult{Key: newKey}
+	if grace > 0 {
+		result.PreviousExpires = time.Now().Add(grace)
+	}
+	rw.WriteCommonResponse(0, "", result)
+}
+
+// rotateKeyCommand 命令行轮换 key：faas rotate-key <path> [new-key]，新 key 输出到标准输出
+func (s *server) rotateKeyCommand(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: rotate-key <path> [new-key]")
+	}
+	p := s.MetaOf(args[0])
+	if !p.Valid() {
+		return errors.New("invalid path")
+	}
+	newKey := ""
+	if len(args) == 2 {
+		newKey = args[1]
+	}
+
+	newKey, err := p.RotateKey(newKey, s.conf.KeyRotationGrace)
+	if err != nil {
+		return err
+	}
+	s.audit.Record(auditEntry{Op: AuditKeyRotate, Path: p.Path(), Auth: AuthCLI, MetaKey: MetaWriteKey})
+	fmt.Println(newKey)
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/faas/tool"
+)
+
+func TestRotateKey(t *testing.T) {
+	p := testServer.MetaOf("/rotate_test")
+	defer p.Destroy()
+	p.SetWriteKey("old-key")
+
+	if code := namedKeyRequest(t, "POST", "/_meta/rotate_test?rotate&grace=1h", "", "old-key", "new-key"); code != 0 {
+		t.Fatal("rotate fail:", code)
+	}
+	if key, _ := p.WriteKey(); key != "new-key" {
+		t.Error("key not rotated:", key)
+	}
+	for _, key := range []string{"old-key", "new-key"} {
+		if code := namedKeyRequest(t, "PUT", "/rotate_test/a.txt", "", key, "a"); code != 0 {
+			t.Error("key rejected in grace period:", key, code)
+		}
+	}
+	//宽限期内的旧 key 不能给自己续期，也不能再次轮换
+	future := `{"Key": "old-key", "Expires": "2100-01-01T00:00:00Z"}`
+	for _, key := range []string{"old-key", "new-key"} {
+		if code := namedKeyRequest(t, "PUT", "/_meta/rotate_test?key=key_previous", "", key, future); code != 403 {
+			t.Error("key_previous set by client:", key, code)
+		}
+	}
+	if code := namedKeyRequest(t, "POST", "/_meta/rotate_test?rotate", "", "old-key", "attacker-key"); code != 403 {
+		t.Error("previous key rotated key:", code)
+	}
+	if code := namedKeyRequest(t, "GET", "/_meta/rotate_test?key=key", "", "old-key", ""); code != 403 {
+		t.Error("previous key read key:", code)
+	}
+	if key, _ := p.WriteKey(); key != "new-key" {
+		t.Error("key taken over:", key)
+	}
+
+	entries, _ := testServer.audit.Query("/rotate_test", time.Time{}, 10)
+	found := false
+	for _, e := range entries {
+		found = found || e.Op == AuditKeyRotate
+	}
+	if !found {
+		t.Error("rotation not audited")
+	}
+
+	//宽限期已过
+	p.Set(MetaPrevKey, []byte(`{"Key": "old-key", "Expires": "2020-01-01T00:00:00Z"}`))
+	if code := namedKeyRequest(t, "PUT", "/rotate_test/a.txt", "", "old-key", "a"); code != 401 {
+		t.Error("expired previous key accepted:", code)
+	}
+
+	//grace=0 立即失效，新 key 由服务端生成
+	mockReq, _ := http.NewRequest("POST", "http://abc.com/_meta/rotate_test?rotate&grace=0", nil)
+	tool.SignRequest("new-key", mockReq)
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, mockReq)
+	var resp struct {
+		Code int
+		Data rotateResult
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Code != 0 || resp.Data.Key == "" {
+		t.Fatal("rotate fail:", rec.Body.String())
+	}
+	if code := namedKeyRequest(t, "PUT", "/rotate_test/a.txt", "", "new-key", "a"); code != 401 {
+		t.Error("previous key accepted without grace:", code)
+	}
+	if code := namedKeyRequest(t, "PUT", "/rotate_test/a.txt", "", resp.Data.Key, "a"); code != 0 {
+		t.Error("generated key rejected:", code)
+	}
+}
+
+func TestRotateKey_Reject(t *testing.T) {
+	defer testServer.MetaOf("/rotate_reject").Destroy()
+	testServer.MetaOf("/rotate_reject").Set(MetaKeys, []byte(`{"ops": {"Key": "ops-secret", "Scopes": ["meta"]}}`))
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+
+	if code := namedKeyRequest(t, "POST", "/_meta/rotate_reject?rotate", "", peekRootKey, ""); code != 400 {
+		t.Error("rotated inherited key:", code)
+	}
+	if code := namedKeyRequest(t, "POST", "/_meta/rotate_reject?rotate", "ops", "ops-secret", ""); code != 403 {
+		t.Error("named key rotated key:", code)
+	}
+}
+
+func TestEnsureRootKey_Rotate(t *testing.T) {
+	root := testServer.MetaOf("/")
+	current, _ := root.WriteKey()
+	root.Del(MetaPrevKey)
+	defer func() {
+		root.SetWriteKey(current)
+		root.Del(MetaPrevKey)
+	}()
+
+	if err := testServer.ensureRootKey("configured-root", false); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _, _ := root.WriteKeys(); strings.Join(keys, ",") != "configured-root,"+current {
+		t.Error("unexpected root keys:", keys)
+	}
+
+	//重启时仍配置着旧 key，不能撤销轮换
+	if err := testServer.ensureRootKey(current, false); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := root.WriteKey(); key != "configured-root" {
+		t.Error("rotation reverted:", key)
+	}
+
+	//再轮换一次后，配置里更早的 key 也不能覆盖
+	if _, err := root.RotateKey("third-root", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := testServer.ensureRootKey(current, false); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := root.WriteKey(); key != "third-root" {
+		t.Error("stale root_key applied:", key)
+	}
+	if err := testServer.ensureRootKey("forced-root", true); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := root.WriteKey(); key != "forced-root" {
+		t.Error("force_root_key not applied:", key)
+	}
+}
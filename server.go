@@ -1,35 +1,167 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"path"
+	"strings"
+	"sync"
 
+	"github.com/google/uuid"
 	"github.com/horsley/faas/tool"
 	"github.com/horsley/svrkit"
 )
 
-func newServer() http.Handler {
+// server 一个服务实例的配置和状态，由 newServer 按配置创建，同一进程中的多个实例互不影响
+type server struct {
+	conf    *Config
+	storage Storage
+	handler http.Handler
+
+	usage      *usageIndex
+	expiries   *expiryIndex
+	changes    *changeHub
+	pathLocks  *keyedMutex
+	passwords  *passwordCache
+	stagingDir string   //本实例写入中的临时内容，多个实例共用存储时互不干扰
+	etags      sync.Map //按路径缓存内容哈希，见 contentETag
+	metrics    *serverMetrics
+	signer     *tool.SignChecker
+
+	accessLog io.Writer //未配置时为 nil
+	audit     *auditLog //未配置时为 nil
+
+	trustedProxies ipMatcher
+	realIPHeaders  []string
+}
+
+// newServer 按配置初始化存储、签名参数和根 key
+func newServer(c *Config) (*server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	s := &server{
+		conf:          c,
+		usage:         newUsageIndex(),
+		changes:       newChangeHub(),
+		pathLocks:     newKeyedMutex(),
+		passwords:     newPasswordCache(),
+		stagingDir:    path.Join(stagingSubDir, uuid.NewString()),
+		metrics:       newServerMetrics(),
+		signer:        &tool.SignChecker{TimeSpan: c.SignWindow.Seconds(), AllowLegacy: c.AllowLegacySign, Nonces: tool.NewNonceCache()},
+		realIPHeaders: c.RealIPHeaders,
+	}
+	s.usage.srv = s
+	s.trustedProxies, _ = parseIPEntries(c.TrustedProxies, nil)
+
+	var err error
+	s.storage, err = newStorage(c.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if c.Encryption.Enabled() {
+		current, old, _ := c.Encryption.masterKeys()
+		s.storage = newEncryptedStorage(s.storage, current, old...)
+	}
+	if s.expiries, err = loadExpiryIndex(s); err != nil {
+		return nil, err
+	}
+
+	if c.AccessLog != "" {
+		if s.accessLog, err = openLogOutput(c.AccessLog, c.LogMaxSize, c.LogMaxBackups); err != nil {
+			return nil, err
+		}
+	}
+	if c.AuditLog != "" {
+		f, err := openRotatingFile(c.AuditLog, c.LogMaxSize, c.LogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		s.audit = &auditLog{file: f}
+	}
+
+	if err := s.ensureRootKey(c.RootKey, c.ForceRootKey); err != nil {
+		return nil, err
+	}
+	s.warnUntrustedProxies()
+
 	mux := svrkit.NewRouter()
 
-	mux.HandleFuncEx("/", handleRequest)
-	return mux
+	mux.HandleFuncEx("/", s.handleRequest)
+	mux.HandleFuncEx(metaAdminPrefix+"/", s.metaAdminHandler)
+	mux.HandleFuncEx(auditPrefix+"/", s.auditHandler)
+	if c.MetricsPath != "" {
+		mux.HandleFuncEx(c.MetricsPath, s.metricsHandler)
+	}
+	s.handler = s.instrumentHandler(mux)
+	return s, nil
 }
 
-func handleRequest(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// ensureRootKey 配置了 root key 时写入存储，否则沿用已有的，都没有则生成。
+// 配置的 root key 变化时按轮换处理，旧 key 在 key_rotation_grace 内仍然有效；
+// 根路径轮换过 key 后存储中的 key 优先，配置里过时的 root_key 不能把已退役的 key 换回来，
+// 除非设置 force_root_key
+func (s *server) ensureRootKey(rootKey string, force bool) error {
+	root := s.MetaOf("/")
+	current, ok := root.WriteKey()
+	if rootKey != "" {
+		if rootKey == current {
+			return nil
+		}
+		if _, rotated := root.Get(MetaPrevKey, false); rotated && !force {
+			log.Println("root key has been rotated, ignoring root_key in config; update it or set force_root_key")
+			return nil
+		}
+		if !ok {
+			return root.SetWriteKey(rootKey)
+		}
+		if _, err := root.RotateKey(rootKey, s.conf.KeyRotationGrace); err != nil {
+			return err
+		}
+		s.audit.Record(auditEntry{Op: AuditKeyRotate, Path: "/", Auth: AuthConfig, MetaKey: MetaWriteKey})
+		return nil
+	}
+	if ok {
+		return nil
+	}
+
+	rootKey = uuid.NewString()
+	log.Println("generated root key:", rootKey)
+	return s.MetaOf("/").SetWriteKey(rootKey)
+}
+
+func (s *server) handleRequest(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+	if q := r.URL.Query(); q.Has("uploads") || q.Has("upload") {
+		s.resumableHandler(rw, r)
+		return
+	}
+
+	if r.Method == "POST" && r.URL.Query().Has("link") {
+		s.linkHandler(rw, r)
+		return
+	}
+
 	if r.Method == "POST" || r.Method == "PUT" {
-		uploadHandler(rw, r)
+		s.uploadHandler(rw, r)
 		return
 	}
 
 	if r.Method == "DELETE" {
-		deleteHandler(rw, r)
+		s.deleteHandler(rw, r)
 		return
 	}
 
-	readFileHandler(rw, r)
+	s.readFileHandler(rw, r)
 }
 
-func uploadHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+func (s *server) uploadHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
 	targetPath := r.URL.Path
 	contentReader := r.Body
 	legacyAuthCheck := false
@@ -50,84 +182,213 @@ func uploadHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
 		}
 	}
 
-	targetMeta := MetaOf(targetPath)
-	writeKey, ok := targetMeta.WriteKey()
-	if !ok {
-		rw.WriteCommonResponse(403, "非法目标", nil)
+	targetMeta := s.MetaOf(targetPath)
+	var auth keyAuth
+	if legacyAuthCheck { //表单上传只支持路径的 key
+		writeKeys, keyLevel, ok := targetMeta.WriteKeys()
+		if !ok {
+			rw.WriteCommonResponse(403, "非法目标", nil)
+			return
+		}
+		if !containsString(writeKeys, r.URL.Query().Get("k")) {
+			rw.WriteCommonResponse(401, "认证失败", nil)
+			return
+		}
+		auth.Level = keyLevel
+	} else {
+		scopes := []string{ScopeUpload}
+		if extract := r.URL.Query().Get("extract"); extract != "" && extract != "merge" {
+			scopes = append(scopes, ScopeDelete) //整体替换会删除压缩包中没有的文件
+		}
+		var err error
+		if auth, err = s.authorize(r, targetMeta, scopes...); err != nil {
+			writeAuthError(rw, err)
+			return
+		}
+		contentReader = r.Body //v2 签名会换成校验哈希的 body
+	}
+	entry := s.newAuditEntry(r, targetMeta, auth, legacyAuthCheck)
+	expiresAt, err := uploadExpiry(r, targetMeta)
+	if err != nil {
+		rw.WriteCommonResponse(400, "过期时间格式错误", nil)
+		return
+	}
+	if r.URL.Query().Get("extract") != "" && !legacyAuthCheck {
+		var body io.Reader = contentReader
+		if s.conf.MaxUploadSize > 0 {
+			body = http.MaxBytesReader(rw, io.NopCloser(body), s.conf.MaxUploadSize)
+		}
+		s.extractHandler(rw, r, targetMeta, body, entry, expiresAt)
+		return
+	}
+	limit, limitByQuota, err := uploadLimit(targetMeta)
+	if errors.Is(err, errQuotaExceeded) {
+		rw.WriteCommonResponse(507, "超出配额", nil)
+		return
+	}
+	if err != nil {
+		log.Println("uploadLimit err:", err, targetPath)
+		rw.WriteCommonResponse(500, "保存失败", nil)
 		return
 	}
+	if limit >= 0 {
+		contentReader = http.MaxBytesReader(rw, io.NopCloser(contentReader), limit)
+	}
 
-	var authPass bool
-	if legacyAuthCheck {
-		authPass = r.URL.Query().Get("k") == writeKey
-	} else {
-		authPass = tool.VerifySign(writeKey, r.Request)
+	//无条件的写入也要加锁，否则可能插到条件写入的检查和保存之间，过期清理也靠这把锁确认没有新写入
+	unlock := s.pathLocks.Lock(targetMeta.Path())
+	defer unlock()
+	if ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match"); ifMatch != "" || ifNoneMatch != "" {
+		if !checkPreconditions(targetMeta, ifMatch, ifNoneMatch) {
+			rw.WriteCommonResponse(412, "前置条件不满足", nil)
+			return
+		}
 	}
-	if !authPass {
-		rw.WriteCommonResponse(401, "认证失败", nil)
+
+	if versionID := r.URL.Query().Get("rollback"); versionID != "" && !legacyAuthCheck {
+		err := targetMeta.Rollback(versionID)
+		if err != nil {
+			log.Println("Rollback err:", err, targetPath, versionID)
+			rw.WriteCommonResponse(500, "回滚失败", nil)
+			return
+		}
+		entry.Op, entry.Version = AuditRollback, versionID
+		if etag, ok := contentETag(targetMeta); ok {
+			rw.Header().Set("ETag", etag)
+			entry.Hash = strings.Trim(etag, `"`)
+		}
+		if info, err := targetMeta.StatContent(); err == nil {
+			entry.Size = info.Size()
+		}
+		s.audit.Record(entry)
+		rw.WriteCommonResponse(0, "", nil)
 		return
 	}
 
-	err := targetMeta.SaveContent(contentReader)
+	err = targetMeta.SaveContent(contentReader)
+	if errors.Is(err, tool.ErrContentHashMismatch) {
+		rw.WriteCommonResponse(400, "内容校验失败", nil)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) && limitByQuota {
+		rw.WriteCommonResponse(507, "超出配额", nil)
+		return
+	}
+	if errors.As(err, &tooLarge) {
+		rw.WriteCommonResponse(413, "文件过大", nil)
+		return
+	}
 	if err != nil {
 		log.Println("SaveContent err:", err, targetPath)
 		rw.WriteCommonResponse(500, "保存失败", nil)
 		return
 	}
 
+	if err := targetMeta.SetExpiry(expiresAt); err != nil {
+		log.Println("SetExpiry err:", err, targetPath)
+	}
+
+	entry.Op = AuditUpload
+	if etag, ok := contentETag(targetMeta); ok {
+		rw.Header().Set("ETag", etag)
+		entry.Hash = strings.Trim(etag, `"`)
+	}
+	if info, err := targetMeta.StatContent(); err == nil {
+		entry.Size = info.Size()
+	}
+	s.audit.Record(entry)
 	rw.WriteCommonResponse(0, "", nil)
 }
 
-func deleteHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+func (s *server) deleteHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
 	targetPath := r.URL.Path
-	targetMeta := MetaOf(targetPath)
-	writeKey, ok := targetMeta.WriteKey()
-	if !ok {
-		rw.WriteCommonResponse(403, "非法目标", nil)
+	targetMeta := s.MetaOf(targetPath)
+	auth, err := s.authorize(r, targetMeta, ScopeDelete)
+	if err != nil {
+		writeAuthError(rw, err)
 		return
 	}
+	entry := s.newAuditEntry(r, targetMeta, auth, false)
+	entry.Op = AuditDelete
+	if etag, ok := contentETag(targetMeta); ok { //记录被删除的内容
+		entry.Hash = strings.Trim(etag, `"`)
+	}
+	if info, err := targetMeta.StatContent(); err == nil && !info.IsDir() {
+		entry.Size = info.Size()
+	}
 
-	if !tool.VerifySign(writeKey, r.Request) {
-		rw.WriteCommonResponse(401, "认证失败", nil)
-		return
+	unlock := s.pathLocks.Lock(targetMeta.Path())
+	defer unlock()
+	if ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match"); ifMatch != "" || ifNoneMatch != "" {
+		if !checkPreconditions(targetMeta, ifMatch, ifNoneMatch) {
+			rw.WriteCommonResponse(412, "前置条件不满足", nil)
+			return
+		}
 	}
 
-	err := targetMeta.Destroy()
+	if r.URL.Query().Has("purge") { //连同历史版本彻底删除
+		entry.Op = AuditPurge
+		err = targetMeta.Destroy()
+	} else {
+		err = targetMeta.SoftDestroy()
+	}
 	if err != nil {
 		log.Println("Destroy err:", err, targetPath)
 		rw.WriteCommonResponse(500, "删除失败", nil)
 		return
 	}
 
+	s.audit.Record(entry)
 	rw.WriteCommonResponse(0, "", nil)
 
 }
 
-func readFileHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
+func (s *server) readFileHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
 	targetPath := r.URL.Path
-	targetMeta := MetaOf(targetPath)
+	targetMeta := s.MetaOf(targetPath)
 	if targetMeta == nil {
 		rw.WriteCommonResponse(403, "非法目标", nil)
 		return
 	}
 
-	if validUserPass := targetMeta.GetBasicAuth(); validUserPass != nil {
-		user, pass, ok := r.BasicAuth()
-		if !ok {
-			rw.Header().Add("WWW-Authenticate", `Basic realm="Give me username and password"`)
-			rw.HTTPError(http.StatusUnauthorized, "need auth")
+	if r.URL.Query().Has("sig") { //下载链接代替读权限检查
+		if !s.linkAccess(rw, r, targetMeta) {
 			return
 		}
+	} else if !s.readAccess(rw, r, targetMeta) {
+		return
+	}
 
-		if validUserPass[user] != pass {
-			rw.HTTPError(http.StatusUnauthorized, "auth fail")
-			return
-
-		}
+	if targetMeta.Expired() { //等待后台清理
+		rw.HTTPError(http.StatusGone, "expired")
+		return
 	}
 
-	if ipChecker := targetMeta.GetIPChecker(); ipChecker != nil && !ipChecker(r.ClientIP()) {
-		rw.HTTPError(http.StatusForbidden, "bad ip:"+r.ClientIP())
+	if q := r.URL.Query(); q.Has("watch") {
+		s.watchHandler(rw, r, targetMeta)
+		return
+	} else if q.Has("usage") {
+		s.usageHandler(rw, r, targetMeta)
+		return
+	} else if q.Has("versions") {
+		versions, err := targetMeta.Versions()
+		if err != nil {
+			rw.HTTPError(http.StatusInternalServerError, "list versions fail")
+			return
+		}
+		rw.WriteCommonResponse(0, "", versions)
+		return
+	} else if versionID := q.Get("version"); versionID != "" {
+		versionName, ok := targetMeta.VersionName(versionID)
+		if !ok {
+			rw.HTTPError(http.StatusNotFound, "version not found")
+			return
+		}
+		if contentType, ok := targetMeta.GetText(MetaContentType, false); ok {
+			rw.Header().Set("Content-Type", contentType)
+		}
+		s.serveStorageFile(rw, r, versionName, path.Base(targetMeta.Path()))
 		return
 	}
 
@@ -136,10 +397,98 @@ func readFileHandler(rw *svrkit.ResponseWriter, r *svrkit.Request) {
 			rw.HTTPError(http.StatusForbidden, "NoIndex")
 			return
 		}
+		if format := r.URL.Query().Get("archive"); format != "" {
+			s.archiveHandler(rw, r, targetMeta, format)
+			return
+		}
+
+		indexName := path.Join(targetMeta.ContentName(), "index.html")
+		if _, err := s.storage.Stat(indexName); err != nil || wantJSON(r) {
+			s.dirListHandler(rw, r, targetMeta)
+			return
+		}
+
+		if !strings.HasSuffix(r.URL.Path, "/") { //页面内用相对链接
+			rw.Redirect(r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.serveStorageFile(rw, r, indexName, "index.html")
+		return
 	}
 
 	if contentType, ok := targetMeta.GetText(MetaContentType, false); ok {
 		rw.Header().Set("Content-Type", contentType)
 	}
-	http.ServeFile(rw, r.Request, targetMeta.ContentPath())
+	if etag, ok := contentETag(targetMeta); ok {
+		rw.Header().Set("ETag", etag) //ServeContent 会据此处理 If-None-Match / If-Match
+	}
+	s.serveStorageFile(rw, r, targetMeta.ContentName(), path.Base(targetMeta.Path()))
+}
+
+// readAccess 检查 basic_auth、ip_check 和 client_cert，不通过时输出响应并返回 false
+func (s *server) readAccess(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta) bool {
+	if validUserPass := targetMeta.GetBasicAuth(); validUserPass != nil {
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			s.metrics.authFailures.Inc("basic_auth", "missing")
+			rw.Header().Add("WWW-Authenticate", `Basic realm="Give me username and password"`)
+			rw.HTTPError(http.StatusUnauthorized, "need auth")
+			return false
+		}
+
+		if !s.checkBasicAuth(validUserPass, user, pass) {
+			if _, known := validUserPass[user]; known {
+				s.metrics.authFailures.Inc("basic_auth", "bad_password")
+			} else {
+				s.metrics.authFailures.Inc("basic_auth", "unknown_user")
+			}
+			rw.HTTPError(http.StatusUnauthorized, "auth fail")
+			return false
+
+		}
+	}
+
+	if ipChecker := targetMeta.GetIPChecker(); ipChecker != nil && !ipChecker(s.clientIP(r)) {
+		s.metrics.authFailures.Inc("ip_check", "denied")
+		rw.HTTPError(http.StatusForbidden, "bad ip:"+s.clientIP(r))
+		return false
+	}
+
+	if certChecker := targetMeta.GetClientCertChecker(); certChecker != nil && !certChecker(r.TLS) {
+		s.metrics.authFailures.Inc("client_cert", "denied")
+		rw.HTTPError(http.StatusForbidden, "bad client cert")
+		return false
+	}
+	return true
+}
+
+// serveStorageFile 从存储后端输出文件，支持 Range 和条件请求
+func (s *server) serveStorageFile(rw *svrkit.ResponseWriter, r *svrkit.Request, name, displayName string) {
+	f, err := s.storage.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(rw, r.Request)
+		return
+	}
+	if err != nil {
+		log.Println("Open content err:", err, name)
+		rw.HTTPError(http.StatusInternalServerError, "open fail")
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(rw, r.Request)
+		return
+	}
+	http.ServeContent(rw, r.Request, displayName, info.ModTime(), f)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"io"
+	"io/fs"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -13,8 +17,70 @@ import (
 	"github.com/horsley/svrkit"
 )
 
+var testServer *server
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "faas-test")
+	if err != nil {
+		panic(err)
+	}
+
+	c := defaultConfig()
+	c.Storage = dir
+	c.AuditLog = filepath.Join(dir, "audit.log")
+	c.MetricsPath = "/metrics"
+	if st := os.Getenv("TEST_STORAGE"); st != "" {
+		c.Storage = st
+	}
+	c.Encryption.Key = os.Getenv("TEST_ENCRYPTION_KEY")
+	testServer, err = newServer(c)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestNewServer_Isolated(t *testing.T) {
+	newMem := func(rootKey string, maxUpload int64) *server {
+		c := defaultConfig()
+		c.Storage = "mem://"
+		c.RootKey = rootKey
+		c.MaxUploadSize = maxUpload
+		s, err := newServer(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	a, b := newMem("key-a", 0), newMem("key-b", 4)
+
+	if err := a.MetaOf("/isolated.txt").SaveContent(strings.NewReader("from a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.MetaOf("/isolated.txt").StatContent(); err == nil {
+		t.Error("content leaked to another server")
+	}
+	if k, _ := b.MetaOf("/").WriteKey(); k != "key-b" {
+		t.Error("unexpected root key:", k)
+	}
+
+	for _, s := range []*server{a, b} {
+		mockReq, _ := http.NewRequest("PUT", "http://abc.com/big.txt", strings.NewReader("hello world"))
+		tool.SignRequest(s.conf.RootKey, mockReq)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, mockReq)
+		_, err := s.MetaOf("/big.txt").StatContent()
+		if (err == nil) != (s == a) {
+			t.Errorf("max upload size of %s not applied per server: %s", s.conf.RootKey, rec.Body.String())
+		}
+	}
+}
+
 func TestLegacyUpload(t *testing.T) {
-	peekRootKey, _ := MetaOf("/").WriteKey()
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
 
 	var buf bytes.Buffer
 	m := multipart.NewWriter(&buf)
@@ -32,7 +98,7 @@ func TestLegacyUpload(t *testing.T) {
 	mockReq.Header.Set("Content-Type", m.FormDataContentType())
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":0,"Data":null,"Message":""}` {
@@ -57,7 +123,7 @@ func TestLegacyUpload_BadPassword(t *testing.T) {
 	mockReq.Header.Set("Content-Type", m.FormDataContentType())
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":401,"Data":null,"Message":"认证失败"}` {
@@ -82,7 +148,7 @@ func TestLegacyUpload_BadForm(t *testing.T) {
 	mockReq.Header.Set("Content-Type", m.FormDataContentType())
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":500,"Data":null,"Message":"请选择文件上传"}` {
@@ -91,7 +157,7 @@ func TestLegacyUpload_BadForm(t *testing.T) {
 }
 
 func TestLegacyUpload_SubItemOfExistedFile(t *testing.T) {
-	peekRootKey, _ := MetaOf("/").WriteKey()
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
 
 	var buf bytes.Buffer
 	m := multipart.NewWriter(&buf)
@@ -111,7 +177,7 @@ func TestLegacyUpload_SubItemOfExistedFile(t *testing.T) {
 	mockReq.Header.Set("Content-Type", m.FormDataContentType())
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":500,"Data":null,"Message":"保存失败"}` {
@@ -120,7 +186,7 @@ func TestLegacyUpload_SubItemOfExistedFile(t *testing.T) {
 }
 
 func TestLegacyUpload_invalidPath(t *testing.T) {
-	peekRootKey, _ := MetaOf("/").WriteKey()
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
 
 	var buf bytes.Buffer
 	m := multipart.NewWriter(&buf)
@@ -140,7 +206,7 @@ func TestLegacyUpload_invalidPath(t *testing.T) {
 	mockReq.Header.Set("Content-Type", m.FormDataContentType())
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":403,"Data":null,"Message":"非法目标"}` {
@@ -149,7 +215,7 @@ func TestLegacyUpload_invalidPath(t *testing.T) {
 }
 
 func TestModernUpload(t *testing.T) {
-	peekRootKey, _ := MetaOf("/").WriteKey()
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
 
 	var buf bytes.Buffer
 	buf.WriteString("hello 2")
@@ -157,7 +223,7 @@ func TestModernUpload(t *testing.T) {
 	tool.SignUpload(peekRootKey, mockReq)
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":0,"Data":null,"Message":""}` {
@@ -169,7 +235,7 @@ func TestRead(t *testing.T) {
 	mockReq, _ := http.NewRequest("GET", "http://abc.com/test_upload2", nil)
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `hello 2` {
@@ -182,7 +248,7 @@ func TestRead304(t *testing.T) {
 	mockReq.Header.Add("If-Modified-Since", time.Now().Add(time.Second).Format(http.TimeFormat))
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	if rec.Result().StatusCode != 304 {
 		t.Error("not using 304", rec.Result().StatusCode)
@@ -197,7 +263,7 @@ func TestReadBadPath(t *testing.T) {
 	mockReq, _ := http.NewRequest("GET", "http://abc.com/../../test_upload3", nil)
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":403,"Data":null,"Message":"非法目标"}` {
@@ -209,7 +275,7 @@ func TestRead404(t *testing.T) {
 	mockReq, _ := http.NewRequest("GET", "http://abc.com/test_upload3", nil)
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != "404 page not found\n" {
@@ -220,10 +286,10 @@ func TestRead404(t *testing.T) {
 func TestReadWithAuth(t *testing.T) {
 	mockReq, _ := http.NewRequest("GET", "http://abc.com/test_upload", nil)
 
-	MetaOf("test_upload").SetBasicAuth(map[string]string{"user": "pass"})
+	testServer.MetaOf("test_upload").SetBasicAuth(map[string]string{"user": "pass"})
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	if rec.Result().StatusCode != 401 {
 		t.Error("not trigger auth")
@@ -231,14 +297,14 @@ func TestReadWithAuth(t *testing.T) {
 
 	rec2 := httptest.NewRecorder()
 	mockReq.SetBasicAuth("user", "bad pass")
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec2}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec2}, &svrkit.Request{Request: mockReq})
 	if rec2.Result().StatusCode != 401 {
 		t.Error("not reject bad auth")
 	}
 
 	rec3 := httptest.NewRecorder()
 	mockReq.SetBasicAuth("user", "pass")
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec3}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec3}, &svrkit.Request{Request: mockReq})
 	if rec3.Result().StatusCode != 200 {
 		t.Error("not accept good auth")
 	}
@@ -247,17 +313,17 @@ func TestReadWithAuth(t *testing.T) {
 func TestDeleteFile(t *testing.T) {
 	mockReq, _ := http.NewRequest("DELETE", "http://abc.com/test_upload", nil)
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":401,"Data":null,"Message":"认证失败"}` {
 		t.Error("unexpected result:", resp)
 	}
 
-	peekRootKey, _ := MetaOf("/").WriteKey()
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
 	tool.SignUpload(peekRootKey, mockReq)
 	rec2 := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec2}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec2}, &svrkit.Request{Request: mockReq})
 
 	resp2 := rec2.Body.String()
 	if resp2 != `{"Code":0,"Data":null,"Message":""}` {
@@ -265,7 +331,7 @@ func TestDeleteFile(t *testing.T) {
 	}
 
 	rec3 := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec3}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec3}, &svrkit.Request{Request: mockReq})
 
 	resp3 := rec3.Body.String()
 	if resp3 != `{"Code":0,"Data":null,"Message":""}` { //dup delete
@@ -277,7 +343,7 @@ func TestDeleteBadPath(t *testing.T) {
 	mockReq, _ := http.NewRequest("DELETE", "http://abc.com/../../test_upload3", nil)
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	resp := rec.Body.String()
 	if resp != `{"Code":403,"Data":null,"Message":"非法目标"}` {
@@ -287,11 +353,11 @@ func TestDeleteBadPath(t *testing.T) {
 
 func TestIPLimit(t *testing.T) {
 	mockReq, _ := http.NewRequest("GET", "http://abc.com/test_upload", nil)
-	MetaOf("test_upload").Set(MetaIPCheck, []byte(`["1.2.3.4"]`))
-	MetaOf("test_upload").SaveContent(strings.NewReader("123"))
+	testServer.MetaOf("test_upload").Set(MetaIPCheck, []byte(`["1.2.3.4"]`))
+	testServer.MetaOf("test_upload").SaveContent(strings.NewReader("123"))
 
 	rec := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
 
 	if rec.Result().StatusCode != 403 {
 		t.Error("not limited")
@@ -299,14 +365,113 @@ func TestIPLimit(t *testing.T) {
 
 	mockReq.RemoteAddr = "1.2.3.4:4556"
 	rec2 := httptest.NewRecorder()
-	handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec2}, &svrkit.Request{Request: mockReq})
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec2}, &svrkit.Request{Request: mockReq})
 
 	if rec2.Result().StatusCode != 200 {
 		t.Error("not allow")
 	}
-	MetaOf("test_upload").Destroy()
+	testServer.MetaOf("test_upload").Destroy()
 }
 
 func TestClean(t *testing.T) {
-	MetaOf("/test_upload2").Destroy()
+	testServer.MetaOf("/test_upload2").Destroy()
+}
+
+func TestModernUpload_SignV2(t *testing.T) {
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	defer testServer.MetaOf("/test_upload_v2").Destroy()
+
+	mockReq, _ := http.NewRequest("PUT", "http://abc.com/test_upload_v2", strings.NewReader("hello v2"))
+	tool.SignRequest(peekRootKey, mockReq)
+	mockReq.Body = io.NopCloser(strings.NewReader("tampered"))
+
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if resp := rec.Body.String(); resp != `{"Code":400,"Data":null,"Message":"内容校验失败"}` {
+		t.Error("unexpected result:", resp)
+	}
+
+	mockReq, _ = http.NewRequest("PUT", "http://abc.com/test_upload_v2", strings.NewReader("hello v2"))
+	tool.SignRequest(peekRootKey, mockReq)
+
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if resp := rec.Body.String(); resp != `{"Code":0,"Data":null,"Message":""}` {
+		t.Error("unexpected result:", resp)
+	}
+
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if resp := rec.Body.String(); resp != `{"Code":401,"Data":null,"Message":"认证失败"}` {
+		t.Error("replay accepted:", resp)
+	}
+}
+
+func TestModernUpload_TooLarge(t *testing.T) {
+	testServer.conf.MaxUploadSize = 4
+	defer func() { testServer.conf.MaxUploadSize = 0 }()
+
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ := http.NewRequest("PUT", "http://abc.com/test_too_large", strings.NewReader("hello"))
+	tool.SignRequest(peekRootKey, mockReq)
+
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if resp := rec.Body.String(); resp != `{"Code":413,"Data":null,"Message":"文件过大"}` {
+		t.Error("unexpected result:", resp)
+	}
+}
+
+func TestShutdown_CleansPartialUpload(t *testing.T) {
+	defer func() { testServer.changes = newChangeHub() }()
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+
+	svr := httptest.NewServer(testServer)
+	defer svr.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ := http.NewRequest("PUT", svr.URL+"/shutdown_test", pr)
+	req.ContentLength = 1 << 20
+	tool.SignUpload(peekRootKey, req)
+	go http.DefaultClient.Do(req)
+	pw.Write(bytes.Repeat([]byte("x"), 4096))
+
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		resp, err := http.Get(svr.URL + "/shutdown_test?watch&wait=1m")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := testServer.shutdown(svr.Config, 200*time.Millisecond); err == nil {
+		t.Error("in-flight upload finished unexpectedly")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("shutdown deadline not respected")
+	}
+	select {
+	case <-watchDone:
+	case <-time.After(time.Second):
+		t.Error("watch request not released by shutdown")
+	}
+
+	if _, err := testServer.storage.Stat("content/shutdown_test"); err == nil {
+		t.Error("partial upload became visible")
+	}
+	if entries, _ := testServer.storage.ReadDir(testServer.stagingDir); len(entries) > 0 {
+		t.Error("staging not cleaned:", len(entries))
+	}
+	if local, ok := testServer.storage.(*localStorage); ok {
+		filepath.WalkDir(local.root, func(name string, d fs.DirEntry, err error) error {
+			if err == nil && strings.HasPrefix(d.Name(), tmpFilePrefix) {
+				t.Error("temp file left:", name)
+			}
+			return nil
+		})
+	}
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage 存储后端，content、meta、历史版本都以 "/" 分隔的相对名字存取，如 content/a/b、meta/a/key
+// 名字不存在时返回的错误需满足 errors.Is(err, fs.ErrNotExist)
+type Storage interface {
+	Open(name string) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	// ReadDir 列出目录的直接子项，按名字排序
+	ReadDir(name string) ([]fs.FileInfo, error)
+	// WriteFile 原子地写入整个文件，上级目录不存在时自动创建
+	WriteFile(name string, rd io.Reader) error
+	// Rename 替换目标文件，读者只会看到旧文件或新文件
+	Rename(oldName, newName string) error
+	// Remove 删除文件或空目录
+	Remove(name string) error
+	// RemoveAll 删除文件或整个目录，不存在时不报错
+	RemoveAll(name string) error
+}
+
+// File 可 Seek 的只读文件，用于 http.ServeContent 的 Range 请求
+type File interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// newStorage 按 STORAGE 配置创建后端：mem:// 内存，s3://bucket/prefix 为 S3 兼容存储，其他为本地目录
+func newStorage(spec string) (Storage, error) {
+	switch {
+	case spec == "mem://":
+		return newMemStorage(), nil
+	case strings.HasPrefix(spec, "s3://"):
+		return newS3StorageFromEnv(strings.TrimPrefix(spec, "s3://"))
+	}
+	return newLocalStorage(spec), nil
+}
+
+func readStorageFile(st Storage, name string) ([]byte, error) {
+	f, err := st.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// staleStagingAge 其他实例的 staging 超过这么久没有写入才视为遗留，
+// 多个副本共用 S3 时不能删掉别的副本进行中的上传
+const staleStagingAge = 24 * time.Hour
+
+// cleanupPartialUploads 清理中断的上传：本实例 staging 中没来得及替换的内容、其他实例（如已崩溃的进程）
+// 遗留的过期 staging，以及本地存储写了一半的临时文件。只在本实例没有请求进行时调用（启动时、停机后）
+func (s *server) cleanupPartialUploads() error {
+	if err := s.storage.RemoveAll(s.stagingDir); err != nil {
+		return err
+	}
+	if err := removeStaleStaging(s.storage, time.Now().Add(-staleStagingAge)); err != nil {
+		return err
+	}
+
+	st := s.storage
+	if enc, ok := st.(*encryptedStorage); ok {
+		st = enc.Storage
+	}
+	if local, ok := st.(*localStorage); ok {
+		return local.removeTempFiles()
+	}
+	return nil
+}
+
+// removeStaleStaging 删除 staging 下 before 之后没有写入过的条目
+func removeStaleStaging(st Storage, before time.Time) error {
+	entries, err := st.ReadDir(stagingSubDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range entries {
+		name := path.Join(stagingSubDir, info.Name())
+		latest := info.ModTime()
+		if info.IsDir() {
+			latest = time.Time{}
+			walkStorage(st, name, func(_ string, info fs.FileInfo) error {
+				if info.ModTime().After(latest) {
+					latest = info.ModTime()
+				}
+				return nil
+			})
+		}
+		if latest.Before(before) {
+			if err := st.RemoveAll(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dirRenamer 能整体移动目录的存储后端
+type dirRenamer interface {
+	RenameDir(oldName, newName string) error
+}
+
+// renameDir 把目录移动到尚不存在的 newName，后端不支持整体移动时逐个文件移动，此时不是原子的
+func renameDir(st Storage, oldName, newName string) error {
+	if r, ok := st.(dirRenamer); ok {
+		return r.RenameDir(oldName, newName)
+	}
+	return walkStorage(st, oldName, func(name string, info fs.FileInfo) error {
+		return st.Rename(name, path.Join(newName, strings.TrimPrefix(name, oldName+"/")))
+	})
+}
+
+// dirSwapper 能原子地交换两个已存在目录的存储后端，读者只会看到旧目录或新目录。
+// extract 整体替换依赖它，不支持的后端（如 S3）只能合并
+type dirSwapper interface {
+	SwapDir(a, b string) error
+}
+
+// asDirSwapper 加密不改变名字，交换目录直接交给底层后端
+func asDirSwapper(st Storage) (dirSwapper, bool) {
+	if enc, ok := st.(*encryptedStorage); ok {
+		st = enc.Storage
+	}
+	sw, ok := st.(dirSwapper)
+	return sw, ok
+}
+
+// walkStorage 深度优先遍历目录下所有文件
+func walkStorage(st Storage, dir string, fn func(name string, info fs.FileInfo) error) error {
+	entries, err := st.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range entries {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			err = walkStorage(st, name, fn)
+		} else {
+			err = fn(name, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func sortFileInfos(infos []fs.FileInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+}
+
+// localStorage 本地目录存储
+type localStorage struct {
+	root string
+}
+
+// tmpFilePrefix 写入中的临时文件前缀，列目录时不展示
+const tmpFilePrefix = ".faas-upload-"
+
+func newLocalStorage(root string) *localStorage {
+	return &localStorage{root: root}
+}
+
+func (s *localStorage) abs(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *localStorage) Open(name string) (File, error) {
+	return os.Open(s.abs(name))
+}
+
+func (s *localStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(s.abs(name))
+}
+
+func (s *localStorage) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(s.abs(name))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), tmpFilePrefix) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+// removeTempFiles 删除进程被杀时遗留的临时文件
+func (s *localStorage) removeTempFiles() error {
+	return filepath.WalkDir(s.root, func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasPrefix(d.Name(), tmpFilePrefix) {
+			return os.Remove(name)
+		}
+		return nil
+	})
+}
+
+// WriteFile 先写同目录临时文件再 rename，读者只会看到旧版本或完整的新版本
+func (s *localStorage) WriteFile(name string, rd io.Reader) error {
+	target := s.abs(name)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(target), tmpFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name()) //rename 成功后是空操作
+
+	_, err = io.Copy(tmpFile, rd)
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), target)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(target))
+	return nil
+}
+
+func (s *localStorage) Rename(oldName, newName string) error {
+	target := s.abs(newName)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(s.abs(oldName), target)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(target))
+	return nil
+}
+
+func (s *localStorage) RenameDir(oldName, newName string) error {
+	return s.Rename(oldName, newName)
+}
+
+func (s *localStorage) Remove(name string) error {
+	return os.Remove(s.abs(name))
+}
+
+func (s *localStorage) RemoveAll(name string) error {
+	if name == "" || name == "." {
+		return fmt.Errorf("refuse to remove storage root")
+	}
+	return os.RemoveAll(s.abs(name))
+}
+
+// syncDir 刷盘目录项，保证 rename 落盘，失败不影响结果
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
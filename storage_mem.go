@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStorage 内存存储，目录由文件名前缀隐式构成，主要用于测试
+type memStorage struct {
+	lock  sync.RWMutex
+	files map[string]*memObject
+}
+
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string]*memObject)}
+}
+
+func memPathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// hasChildren 调用方需持有锁
+func (s *memStorage) hasChildren(name string) bool {
+	prefix := name + "/"
+	for k := range s.files {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWritable 目标不能是目录，上级不能是文件，调用方需持有锁
+func (s *memStorage) checkWritable(name string) error {
+	if s.hasChildren(name) {
+		return memPathError("write", name, errors.New("is a directory"))
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, ok := s.files[dir]; ok {
+			return memPathError("write", name, errors.New("not a directory"))
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) Open(name string) (File, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, ok := s.files[name]
+	if !ok {
+		return nil, memPathError("open", name, fs.ErrNotExist)
+	}
+	return &memFile{
+		Reader: bytes.NewReader(obj.data),
+		info:   &fileInfo{name: path.Base(name), size: int64(len(obj.data)), modTime: obj.modTime},
+	}, nil
+}
+
+func (s *memStorage) Stat(name string) (fs.FileInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if obj, ok := s.files[name]; ok {
+		return &fileInfo{name: path.Base(name), size: int64(len(obj.data)), modTime: obj.modTime}, nil
+	}
+	if s.hasChildren(name) {
+		return &fileInfo{name: path.Base(name), isDir: true}, nil
+	}
+	return nil, memPathError("stat", name, fs.ErrNotExist)
+}
+
+func (s *memStorage) ReadDir(name string) ([]fs.FileInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	prefix := name + "/"
+	seen := make(map[string]bool)
+	var result []fs.FileInfo
+	for k, obj := range s.files {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		child, _, isDir := strings.Cut(strings.TrimPrefix(k, prefix), "/")
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		if isDir {
+			result = append(result, &fileInfo{name: child, isDir: true})
+		} else {
+			result = append(result, &fileInfo{name: child, size: int64(len(obj.data)), modTime: obj.modTime})
+		}
+	}
+	if len(result) == 0 {
+		if _, ok := s.files[name]; ok {
+			return nil, memPathError("readdir", name, errors.New("not a directory"))
+		}
+		return nil, memPathError("readdir", name, fs.ErrNotExist)
+	}
+	sortFileInfos(result)
+	return result, nil
+}
+
+func (s *memStorage) WriteFile(name string, rd io.Reader) error {
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.checkWritable(name); err != nil {
+		return err
+	}
+	s.files[name] = &memObject{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (s *memStorage) Rename(oldName, newName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.files[oldName]
+	if !ok {
+		return memPathError("rename", oldName, fs.ErrNotExist)
+	}
+	if err := s.checkWritable(newName); err != nil {
+		return err
+	}
+	delete(s.files, oldName)
+	s.files[newName] = obj
+	return nil
+}
+
+func (s *memStorage) RenameDir(oldName, newName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.files[newName]; ok || s.hasChildren(newName) {
+		return memPathError("rename", newName, fs.ErrExist)
+	}
+	if err := s.checkWritable(newName); err != nil {
+		return err
+	}
+	prefix := oldName + "/"
+	var names []string
+	for k := range s.files {
+		if strings.HasPrefix(k, prefix) {
+			names = append(names, k)
+		}
+	}
+	if len(names) == 0 {
+		return memPathError("rename", oldName, fs.ErrNotExist)
+	}
+	for _, k := range names {
+		s.files[newName+"/"+strings.TrimPrefix(k, prefix)] = s.files[k]
+		delete(s.files, k)
+	}
+	return nil
+}
+
+func (s *memStorage) SwapDir(a, b string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prefixA, prefixB := a+"/", b+"/"
+	moved := make(map[string]*memObject)
+	for k, obj := range s.files {
+		switch {
+		case strings.HasPrefix(k, prefixA):
+			moved[prefixB+strings.TrimPrefix(k, prefixA)] = obj
+		case strings.HasPrefix(k, prefixB):
+			moved[prefixA+strings.TrimPrefix(k, prefixB)] = obj
+		default:
+			continue
+		}
+		delete(s.files, k)
+	}
+	for k, obj := range moved {
+		s.files[k] = obj
+	}
+	return nil
+}
+
+func (s *memStorage) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.files[name]; ok {
+		delete(s.files, name)
+		return nil
+	}
+	if s.hasChildren(name) {
+		return memPathError("remove", name, errors.New("directory not empty"))
+	}
+	return memPathError("remove", name, fs.ErrNotExist)
+}
+
+func (s *memStorage) RemoveAll(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prefix := name + "/"
+	for k := range s.files {
+		if k == name || strings.HasPrefix(k, prefix) {
+			delete(s.files, k)
+		}
+	}
+	return nil
+}
+
+type memFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
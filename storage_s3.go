@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Storage S3 兼容的对象存储（AWS S3、MinIO 等），使用 path-style 地址和 SigV4 签名
+// 目录由对象名前缀隐式构成，多个无状态实例可以共享同一个 bucket
+type s3Storage struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// newS3StorageFromEnv spec 为 bucket/prefix，连接信息取自 S3_ENDPOINT、S3_REGION、S3_ACCESS_KEY、S3_SECRET_KEY
+func newS3StorageFromEnv(spec string) (*s3Storage, error) {
+	bucket, prefix, _ := strings.Cut(spec, "/")
+	if bucket == "" {
+		return nil, errors.New("s3 bucket required")
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, errors.New("S3_ENDPOINT required")
+	}
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return newS3Storage(endpoint, bucket, prefix, region, os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY")), nil
+}
+
+func newS3Storage(endpoint, bucket, prefix, region, accessKey, secretKey string) *s3Storage {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Storage{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (s *s3Storage) key(name string) string {
+	return s.prefix + name
+}
+
+// do 发送签名请求，key 为空时请求 bucket 本身
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	target := s.endpoint + "/" + s.bucket
+	if key != "" {
+		target += "/" + awsEscape(key, false)
+	}
+	if len(query) > 0 {
+		target += "?" + awsQuery(query)
+	}
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign AWS SigV4 签名，负载不参与签名
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(signingKey, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape RFC 3986 编码，仅保留非保留字符
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3Error(op, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("s3 status %d: %s", resp.StatusCode, msg)}
+}
+
+func (s *s3Storage) headObject(name string) (*fileInfo, error) {
+	resp, err := s.do("HEAD", s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("stat", name, resp)
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &fileInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// list ListObjectsV2，delimiter 为空时递归列出全部对象
+func (s *s3Storage) list(prefix, delimiter string, maxKeys int, fn func(*s3ListResult) bool) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if maxKeys > 0 {
+			query.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do("GET", "", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s3Error("list", prefix, resp)
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if !fn(&result) || !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) hasChildren(name string) (bool, error) {
+	found := false
+	err := s.list(s.key(name)+"/", "", 1, func(r *s3ListResult) bool {
+		found = len(r.Contents) > 0
+		return false
+	})
+	return found, err
+}
+
+func (s *s3Storage) Open(name string) (File, error) {
+	info, err := s.headObject(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s: s, name: name, info: info}, nil
+}
+
+func (s *s3Storage) Stat(name string) (fs.FileInfo, error) {
+	info, err := s.headObject(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return info, err
+	}
+
+	isDir, listErr := s.hasChildren(name)
+	if listErr != nil {
+		return nil, listErr
+	}
+	if !isDir {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), isDir: true}, nil
+}
+
+func (s *s3Storage) ReadDir(name string) ([]fs.FileInfo, error) {
+	prefix := s.key(name) + "/"
+	var result []fs.FileInfo
+	err := s.list(prefix, "/", 0, func(r *s3ListResult) bool {
+		for _, c := range r.Contents {
+			if child := strings.TrimPrefix(c.Key, prefix); child != "" {
+				result = append(result, &fileInfo{name: child, size: c.Size, modTime: c.LastModified})
+			}
+		}
+		for _, p := range r.CommonPrefixes {
+			result = append(result, &fileInfo{name: strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"), isDir: true})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sortFileInfos(result)
+	return result, nil
+}
+
+// WriteFile S3 的 PUT 本身是原子的，先落到本地临时文件以拿到长度
+func (s *s3Storage) WriteFile(name string, rd io.Reader) error {
+	tmp, err := os.CreateTemp("", tmpFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, rd)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	resp, err := s.do("PUT", s.key(name), nil, nil, tmp, size)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("write", name, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename 服务端复制后删除源对象
+func (s *s3Storage) Rename(oldName, newName string) error {
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s.bucket + "/" + awsEscape(s.key(oldName), false)}}
+	resp, err := s.do("PUT", s.key(newName), nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("rename", oldName, resp)
+	}
+	resp.Body.Close()
+
+	return s.deleteObject(oldName)
+}
+
+func (s *s3Storage) deleteObject(name string) error {
+	resp, err := s.do("DELETE", s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("remove", name, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Remove(name string) error {
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	return s.deleteObject(name)
+}
+
+func (s *s3Storage) RemoveAll(name string) error {
+	if name == "" {
+		return errors.New("refuse to remove storage root")
+	}
+
+	var keys []string
+	err := s.list(s.key(name)+"/", "", 0, func(r *s3ListResult) bool {
+		for _, c := range r.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range append(keys, name) {
+		if err := s.deleteObject(k); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3File 按需发起 Range GET，Seek 之后重新请求
+type s3File struct {
+	s      *s3Storage
+	name   string
+	info   *fileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.offset)}}
+		resp, err := f.s.do("GET", f.s.key(f.name), nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			return 0, s3Error("read", f.name, resp)
+		}
+		if resp.StatusCode == http.StatusOK && f.offset > 0 { //不支持 Range 的服务端
+			if _, err := io.CopyN(io.Discard, resp.Body, f.offset); err != nil {
+				resp.Body.Close()
+				return 0, err
+			}
+		}
+		f.body = resp.Body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = f.offset + offset
+	case io.SeekEnd:
+		target = f.info.size + offset
+	default:
+		return 0, errors.New("bad whence")
+	}
+	if target < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if target != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = target
+	return target, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
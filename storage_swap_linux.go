@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// SwapDir 用 renameat2(RENAME_EXCHANGE) 一次交换两个目录
+func (s *localStorage) SwapDir(a, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, s.abs(a), unix.AT_FDCWD, s.abs(b), unix.RENAME_EXCHANGE)
+	if err != nil {
+		return &os.LinkError{Op: "swap", Old: s.abs(a), New: s.abs(b), Err: err}
+	}
+	syncDir(filepath.Dir(s.abs(a)))
+	syncDir(filepath.Dir(s.abs(b)))
+	return nil
+}
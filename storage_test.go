@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func testStorage(t *testing.T, st Storage) {
+	if err := st.WriteFile("content/a/b.txt", strings.NewReader("hello world")); err != nil {
+		t.Fatal("write err", err)
+	}
+	st.WriteFile("content/a/c/d", strings.NewReader("d"))
+
+	if _, isS3 := st.(*s3Storage); !isS3 { //对象存储没有目录概念，不做此检查
+		if st.WriteFile("content/a/b.txt/x", strings.NewReader("x")) == nil {
+			t.Error("write under a file")
+		}
+	}
+
+	if err := st.WriteFile("content/a/b.txt", iotest.ErrReader(errors.New("broken"))); err == nil {
+		t.Error("broken reader not reported")
+	}
+	if bin, _ := readStorageFile(st, "content/a/b.txt"); string(bin) != "hello world" {
+		t.Error("failed write destroyed old content:", string(bin))
+	}
+
+	f, err := st.Open("content/a/b.txt")
+	if err != nil {
+		t.Fatal("open err", err)
+	}
+	f.Seek(6, io.SeekStart)
+	if bin, _ := io.ReadAll(f); string(bin) != "world" {
+		t.Error("seek read not match:", string(bin))
+	}
+	if info, _ := f.Stat(); info.Size() != 11 || info.IsDir() {
+		t.Error("unexpected file info", info.Size(), info.IsDir())
+	}
+	f.Close()
+
+	if info, err := st.Stat("content/a"); err != nil || !info.IsDir() {
+		t.Error("dir stat err", err)
+	}
+	if _, err := st.Stat("content/nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("missing stat err", err)
+	}
+	if _, err := st.Open("content/nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("missing open err", err)
+	}
+
+	entries, err := st.ReadDir("content/a")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "b.txt" || entries[1].Name() != "c" || !entries[1].IsDir() {
+		t.Error("unexpected dir entries", entries, err)
+	}
+
+	if err := st.Rename("content/a/b.txt", "content/e/f"); err != nil {
+		t.Error("rename err", err)
+	}
+	if bin, _ := readStorageFile(st, "content/e/f"); string(bin) != "hello world" {
+		t.Error("renamed content not match:", string(bin))
+	}
+	if _, err := st.Stat("content/a/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("rename source left")
+	}
+
+	st.WriteFile("content/g/h/i", strings.NewReader("i"))
+	if err := renameDir(st, "content/g", "content/j/k"); err != nil {
+		t.Error("rename dir err", err)
+	}
+	if bin, _ := readStorageFile(st, "content/j/k/h/i"); string(bin) != "i" {
+		t.Error("renamed dir content not match:", string(bin))
+	}
+	if _, err := st.Stat("content/g/h/i"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("rename dir source left")
+	}
+	st.RemoveAll("content/j")
+
+	if sw, ok := asDirSwapper(st); ok {
+		st.WriteFile("content/s1/x", strings.NewReader("1"))
+		st.WriteFile("content/s2/y/z", strings.NewReader("2"))
+		if err := sw.SwapDir("content/s1", "content/s2"); err != nil {
+			t.Error("swap dir err", err)
+		}
+		if bin, _ := readStorageFile(st, "content/s2/x"); string(bin) != "1" {
+			t.Error("swapped content not match:", string(bin))
+		}
+		if bin, _ := readStorageFile(st, "content/s1/y/z"); string(bin) != "2" {
+			t.Error("swapped content not match:", string(bin))
+		}
+		if _, err := st.Stat("content/s2/y"); !errors.Is(err, fs.ErrNotExist) {
+			t.Error("old dir left after swap")
+		}
+		st.RemoveAll("content/s1")
+		st.RemoveAll("content/s2")
+	}
+
+	if st.Remove("content/a") == nil {
+		t.Error("remove non-empty dir")
+	}
+	if err := st.RemoveAll("content/a"); err != nil {
+		t.Error("remove all err", err)
+	}
+	if _, err := st.Stat("content/a/c/d"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("remove all left files")
+	}
+	if err := st.Remove("content/e/f"); err != nil {
+		t.Error("remove err", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	testStorage(t, newLocalStorage(t.TempDir()))
+}
+
+func TestMemStorage(t *testing.T) {
+	testStorage(t, newMemStorage())
+}
+
+func TestS3Storage(t *testing.T) {
+	fake := newFakeS3("test-bucket", "AKID")
+	svr := httptest.NewServer(fake)
+	defer svr.Close()
+
+	testStorage(t, newS3Storage(svr.URL, "test-bucket", "faas", "us-east-1", "AKID", "secret"))
+
+	if len(fake.objects) != 0 {
+		t.Error("objects left:", fake.objects)
+	}
+}
+
+// fakeS3 本地模拟的 S3 兼容服务，只实现用到的接口
+type fakeS3 struct {
+	bucket    string
+	accessKey string
+	lock      sync.Mutex
+	objects   map[string]fakeS3Object
+}
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3(bucket, accessKey string) *fakeS3 {
+	return &fakeS3{bucket: bucket, accessKey: accessKey, objects: make(map[string]fakeS3Object)}
+}
+
+func (s *fakeS3) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if key == "" && r.Method == "GET" {
+		s.list(rw, r)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD", "GET":
+		obj, ok := s.objects[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		data := obj.data
+		if rng := r.Header.Get("Range"); r.Method == "GET" && rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			data = data[start:]
+			rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			rw.WriteHeader(http.StatusPartialContent)
+		} else {
+			rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if r.Method == "GET" {
+			rw.Write(data)
+		}
+	case "PUT":
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			srcKey := strings.TrimPrefix(src, "/"+s.bucket+"/")
+			obj, ok := s.objects[srcKey]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s.objects[key] = fakeS3Object{obj.data, time.Now()}
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		s.objects[key] = fakeS3Object{data, time.Now()}
+	case "DELETE":
+		delete(s.objects, key)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fakeS3) list(rw http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var result s3ListResult
+	seen := map[string]bool{}
+	for _, k := range keys {
+		rest := strings.TrimPrefix(k, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{p})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}{k, int64(len(s.objects[k].data)), s.objects[k].modTime})
+	}
+
+	rw.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(rw, xml.Header)
+	xml.NewEncoder(rw).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: result})
+}
+
+func TestCleanupPartialUploads_OtherInstances(t *testing.T) {
+	c := defaultConfig()
+	c.Storage = t.TempDir()
+	s, err := newServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.storage.WriteFile(path.Join(s.stagingDir, "mine"), strings.NewReader("x"))
+	s.storage.WriteFile("staging/other-running/a", strings.NewReader("x"))
+	s.storage.WriteFile("staging/other-crashed/a", strings.NewReader("x"))
+	old := time.Now().Add(-2 * staleStagingAge)
+	os.Chtimes(filepath.Join(c.Storage, "staging/other-crashed/a"), old, old)
+
+	if err := s.cleanupPartialUploads(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		s.stagingDir:            false,
+		"staging/other-running": true,
+		"staging/other-crashed": false,
+	} {
+		if _, err := s.storage.Stat(name); (err == nil) != want {
+			t.Error("unexpected cleanup result:", name, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader 持有当前的证书和客户端 CA，文件变化或收到 SIGHUP 时重新加载，
+// 加载失败时继续使用旧的证书
+type certReloader struct {
+	conf TLSConfig
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func newCertReloader(c TLSConfig) (*certReloader, error) {
+	r := &certReloader{conf: c}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.conf.Cert, r.conf.Key}
+	if r.conf.ClientCA != "" {
+		files = append(files, r.conf.ClientCA)
+	}
+	return files
+}
+
+// Reload 重新读取证书文件
+func (r *certReloader) Reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, name := range r.files() {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		modTimes[name] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.conf.Cert, r.conf.Key)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.conf.ClientCA != "" {
+		pem, err := os.ReadFile(r.conf.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in " + r.conf.ClientCA)
+		}
+	}
+
+	r.lock.Lock()
+	r.cert, r.clientCAs, r.modTimes = &cert, pool, modTimes
+	r.lock.Unlock()
+	return nil
+}
+
+// changed 证书文件的修改时间是否和上次加载时不同
+func (r *certReloader) changed() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for name, modTime := range r.modTimes {
+		info, err := os.Stat(name)
+		if err != nil { //正在替换文件时可能短暂不存在，下次再看
+			return false
+		}
+		if !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch 定时检查文件变化，同时监听 SIGHUP，阻塞运行
+func (r *certReloader) Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if r.conf.ReloadInterval > 0 {
+		ticker := time.NewTicker(r.conf.ReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+		}
+		if err := r.Reload(); err != nil {
+			log.Println("reload tls cert err:", err)
+			continue
+		}
+		log.Println("tls cert reloaded")
+	}
+}
+
+// TLSConfig 每次握手取当前的证书和客户端 CA
+func (r *certReloader) TLSConfig() *tls.Config {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+		return r.cert, nil
+	}
+	if r.conf.ClientCA == "" {
+		return base
+	}
+
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.clientCAs
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.conf.ClientAuth == "require" {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return c, nil
+	}
+	return base
+}
+
+// parseClientCertRules client_cert 为主题列表，条目可以是完整的 DN（如 "CN=deploy,O=ops"）或只写 CN
+func parseClientCertRules(content []byte) ([]string, error) {
+	var subjects []string
+	if err := json.Unmarshal(content, &subjects); err != nil {
+		return nil, err
+	}
+	for _, v := range subjects {
+		if strings.TrimSpace(v) == "" {
+			return nil, errors.New("empty client cert subject")
+		}
+	}
+	return subjects, nil
+}
+
+// matchClientCert 只认经过 CA 校验的客户端证书
+func matchClientCert(state *tls.ConnectionState, subjects []string) bool {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return false
+	}
+	leaf := state.VerifiedChains[0][0]
+	dn := leaf.Subject.String()
+	for _, v := range subjects {
+		v = strings.TrimSpace(v)
+		if v == dn || v == leaf.Subject.CommonName || v == "CN="+leaf.Subject.CommonName {
+			return true
+		}
+	}
+	return false
+}
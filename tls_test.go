@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"faas"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) writeTo(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	if err := os.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := newTestCert(t, "first", nil, false)
+	first.writeTo(t, certFile, keyFile, time.Now().Add(-time.Minute))
+
+	r, err := newCertReloader(TLSConfig{Cert: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	getCert := r.TLSConfig().GetCertificate
+	currentCN := func() string {
+		cert, _ := getCert(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if currentCN() != "first" {
+		t.Error("unexpected initial cert")
+	}
+	if r.changed() {
+		t.Error("unchanged files reported as changed")
+	}
+
+	second := newTestCert(t, "second", nil, false)
+	second.writeTo(t, certFile, keyFile, time.Now())
+	if !r.changed() {
+		t.Fatal("cert change not detected")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := currentCN(); cn != "second" {
+		t.Error("cert not reloaded:", cn)
+	}
+
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	if r.Reload() == nil {
+		t.Error("broken key accepted")
+	}
+	if currentCN() != "second" {
+		t.Error("old cert dropped after failed reload")
+	}
+}
+
+func TestClientCertMeta(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test ca", nil, true)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, ca.certPEM, 0600)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestCert(t, "server", ca, false).writeTo(t, certFile, keyFile, time.Now())
+
+	r, err := newCertReloader(TLSConfig{Cert: certFile, Key: keyFile, ClientCA: caFile, ClientAuth: "optional"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testServer.MetaOf("/client_cert_test").SaveContent(strings.NewReader("secret"))
+	testServer.MetaOf("/client_cert_test").Set(MetaClientCert, []byte(`["deploy", "CN=backup,O=faas"]`))
+	defer testServer.MetaOf("/client_cert_test").Destroy()
+
+	svr := httptest.NewUnstartedServer(testServer)
+	svr.TLS = r.TLSConfig()
+	svr.StartTLS()
+	defer svr.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(client *testCert) int {
+		tlsConf := &tls.Config{RootCAs: roots}
+		if client != nil {
+			pair, _ := tls.X509KeyPair(client.certPEM, client.keyPEM)
+			tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &pair, nil //不管签发者是否匹配都发送
+			}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+		resp, err := c.Get(svr.URL + "/client_cert_test")
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for name, tc := range map[string]struct {
+		client *testCert
+		want   int
+	}{
+		"no cert":      {nil, http.StatusForbidden},
+		"cn match":     {newTestCert(t, "deploy", ca, false), http.StatusOK},
+		"dn match":     {newTestCert(t, "backup", ca, false), http.StatusOK},
+		"other cn":     {newTestCert(t, "intruder", ca, false), http.StatusForbidden},
+		"untrusted ca": {newTestCert(t, "deploy", nil, false), 0}, //握手失败
+	} {
+		if got := get(tc.client); got != tc.want {
+			t.Error(name, "unexpected status:", got)
+		}
+	}
+
+	if MetaClientCert.Validate([]byte(`"deploy"`)) == nil {
+		t.Error("non array client_cert accepted")
+	}
+}
@@ -0,0 +1,36 @@
+package tool
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// CreateLink 生成 target 的下载链接，ttl 为 0 时用服务端默认有效期，maxDownloads 为 0 时不限次数。
+// 返回完整的 url，持有者无需 basic_auth 等读权限即可下载
+func CreateLink(target, key string, ttl time.Duration, maxDownloads int, opts ...RequestOption) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{"link": {""}}
+	if ttl > 0 {
+		q.Set("ttl", ttl.String())
+	}
+	if maxDownloads > 0 {
+		q.Set("max", strconv.Itoa(maxDownloads))
+	}
+	u.RawQuery = q.Encode()
+
+	var result struct {
+		URL string
+	}
+	if err := doSignedData("POST", u.String(), key, nil, opts, &result); err != nil {
+		return "", err
+	}
+	link, err := u.Parse(result.URL)
+	if err != nil {
+		return "", err
+	}
+	return link.String(), nil
+}
@@ -2,73 +2,248 @@ package tool
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"time"
 )
 
-// Poll 定时拉URL
-func Poll(url string, interval time.Duration, onChange func(old, new []byte)) {
+// DefaultPollTimeout Poller 未指定 Client 时单次请求的超时
+var DefaultPollTimeout = 30 * time.Second
 
-	var lastModify string
-	var lastBin []byte
-	for range time.NewTicker(interval).C {
-		func() {
-			req, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				log.Println("create poll request err:", err)
-				return
-			}
+// Poller 定时拉取 URL 并回调内容变化，用 Run 启动，ctx 取消后退出
+type Poller struct {
+	URL      string
+	Interval time.Duration
 
-			if lastModify != "" {
-				req.Header.Add("If-Modified-Since", lastModify)
-			}
+	// Client 为空时使用带 DefaultPollTimeout 超时的 client
+	Client *http.Client
 
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				log.Println("Poll got error:", err)
-				return
-			}
-			defer resp.Body.Close()
+	// Username Password 访问有 basic_auth 的路径时使用
+	Username string
+	Password string
 
-			if resp.StatusCode == http.StatusNotModified {
-				return
-			}
+	// MaxBackoff 连续出错时退避的上限，默认为 Interval 的 10 倍
+	MaxBackoff time.Duration
 
-			bin, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Println("Poll read error:", err)
-				return
-			}
+	// OnInit 首次拿到内容时回调
+	OnInit func(content []byte)
+	// OnChange 内容变化时回调，删除后重新出现时 old 为 nil
+	OnChange func(old, new []byte)
+	// OnDelete 内容被删除（404）时回调
+	OnDelete func(old []byte)
+	// OnError 出错时回调，为空则打日志
+	OnError func(err error)
+
+	lastBin    []byte
+	lastModify string
+	etag       string
+	loaded     bool
+}
 
-			if resp.StatusCode == http.StatusOK {
-				if bytes.Equal(lastBin, bin) {
-					return
-				}
-
-				if lastBin != nil {
-					onChange(lastBin, bin)
-				}
-				lastBin = bin
-				lastModify = resp.Header.Get("Last-Modified")
-				return
+// Run 开始轮询，阻塞直到 ctx 结束
+func (p *Poller) Run(ctx context.Context) error {
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultPollTimeout}
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * p.Interval
+	}
+
+	failures := 0
+	for {
+		wait := p.Interval
+		if err := p.pollOnce(ctx, client); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			p.reportError(err)
+			failures++
+			wait = backoff(p.Interval, maxBackoff, failures)
+		} else {
+			failures = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff 指数退避，取 [d/2, d] 之间的随机值避免大量客户端同时重试
+func backoff(base, max time.Duration, failures int) time.Duration {
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 1 {
+		return base
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func (p *Poller) reportError(err error) {
+	if p.OnError != nil {
+		p.OnError(err)
+		return
+	}
+	log.Println("Poll got error:", err)
+}
+
+func (p *Poller) pollOnce(ctx context.Context, client *http.Client) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	if p.Username != "" || p.Password != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	if p.lastModify != "" {
+		req.Header.Set("If-Modified-Since", p.lastModify)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		io.Copy(io.Discard, resp.Body)
+		if p.lastBin != nil && p.OnDelete != nil {
+			p.OnDelete(p.lastBin)
+		}
+		p.lastBin, p.lastModify, p.etag = nil, "", ""
+		return nil
+	case http.StatusOK:
+	default:
+		bin, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("poll http error: %d %s", resp.StatusCode, bin)
+	}
+
+	bin, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	p.lastModify = resp.Header.Get("Last-Modified")
+	p.etag = resp.Header.Get("ETag")
+
+	switch {
+	case !p.loaded:
+		p.loaded = true
+		if p.OnInit != nil {
+			p.OnInit(bin)
+		}
+	case p.lastBin == nil || !bytes.Equal(p.lastBin, bin):
+		if p.OnChange != nil {
+			p.OnChange(p.lastBin, bin)
+		}
+	}
+	p.lastBin = bin
+	return nil
+}
+
+// Poll 定时拉URL，永不退出，需要停止或更多回调请用 Poller
+func Poll(url string, interval time.Duration, onChange func(old, new []byte)) {
+	(&Poller{URL: url, Interval: interval, OnChange: onChange}).Run(context.Background())
+}
+
+// ErrPreconditionFailed If-Match / If-None-Match 条件不满足
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// RequestOption 上传、删除请求的可选项
+type RequestOption func(req *http.Request)
+
+// IfMatch 仅当服务端内容的 ETag 匹配时才写入，用于乐观并发控制
+func IfMatch(etag string) RequestOption {
+	return func(req *http.Request) {
+		req.Header.Set("If-Match", etag)
+	}
+}
+
+// IfNoneMatch 传 "*" 表示仅当目标不存在时才创建
+func IfNoneMatch(etag string) RequestOption {
+	return func(req *http.Request) {
+		req.Header.Set("If-None-Match", etag)
+	}
+}
 
-			log.Println("Poll http error:", resp.StatusCode, string(bin[:200]))
-		}()
+// KeyName 用路径上名为 name 的命名 key 签名，key 参数传该命名 key 的值
+func KeyName(name string) RequestOption {
+	return func(req *http.Request) {
+		req.Header.Set(KeyNameHeader, name)
 	}
 }
 
 // Upload 上传内容
-func Upload(url, key string, content io.Reader) error {
-	req, err := http.NewRequest("PUT", url, content)
+func Upload(url, key string, content io.Reader, opts ...RequestOption) error {
+	return doSigned("PUT", url, key, content, opts)
+}
+
+// Delete 删除内容
+func Delete(url, key string, opts ...RequestOption) error {
+	return doSigned("DELETE", url, key, nil, opts)
+}
+
+func doSigned(method, url, key string, content io.Reader, opts []RequestOption) error {
+	return doSignedData(method, url, key, content, opts, nil)
+}
+
+// ResponseError 服务端返回了非 0 的 Code
+type ResponseError struct {
+	Code    int
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// signClientRequest 按 UseSignV2 选择签名方案，v2 时能 Seek 的内容流式计算哈希
+func signClientRequest(key string, req *http.Request, content io.Reader) error {
+	if !UseSignV2 {
+		SignUpload(key, req)
+		return nil
+	}
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		return SignRequestSeeker(key, req, seeker)
+	}
+	return SignRequest(key, req)
+}
+
+// doSignedData 发送签名请求，成功时把响应的 Data 解析到 data（可为 nil）
+func doSignedData(method, url, key string, content io.Reader, opts []RequestOption, data interface{}) error {
+	req, err := http.NewRequest(method, url, content)
 	if err != nil {
 		return err
 	}
-	SignUpload(key, req)
+	for _, opt := range opts {
+		opt(req)
+	}
+	if err = signClientRequest(key, req, content); err != nil {
+		return err
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -85,6 +260,7 @@ func Upload(url, key string, content io.Reader) error {
 	var respData struct {
 		Code    int
 		Message string
+		Data    json.RawMessage
 	}
 
 	err = json.Unmarshal(bin, &respData)
@@ -92,9 +268,15 @@ func Upload(url, key string, content io.Reader) error {
 		return err
 	}
 
+	if respData.Code == http.StatusPreconditionFailed {
+		return ErrPreconditionFailed
+	}
 	if respData.Code != 0 {
-		return errors.New(respData.Message)
+		return &ResponseError{Code: respData.Code, Message: respData.Message}
 	}
 
+	if data != nil && len(respData.Data) > 0 {
+		return json.Unmarshal(respData.Data, data)
+	}
 	return nil
 }
@@ -1,8 +1,11 @@
 package tool
 
 import (
+	"context"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
@@ -65,3 +68,67 @@ func TestPoll(t *testing.T) {
 	Upload(TestHTTPHost+"/config/login.yaml", TestDirKey, strings.NewReader(newContent))
 	wg.Wait()
 }
+
+func TestPoller(t *testing.T) {
+	var lock sync.Mutex
+	content, status := "v1", http.StatusOK
+	svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.WriteHeader(status)
+		io.WriteString(rw, content)
+	}))
+	defer svr.Close()
+
+	set := func(c string, s int) {
+		lock.Lock()
+		content, status = c, s
+		lock.Unlock()
+	}
+
+	events := make(chan string, 10)
+	p := &Poller{
+		URL:      svr.URL,
+		Interval: 10 * time.Millisecond,
+		Username: "user",
+		Password: "pass",
+		OnInit:   func(content []byte) { events <- "init:" + string(content) },
+		OnChange: func(old, new []byte) { events <- "change:" + string(old) + ">" + string(new) },
+		OnDelete: func(old []byte) { events <- "delete:" + string(old) },
+		OnError:  func(err error) { events <- "error" },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	expect := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("got event %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	expect("init:v1")
+	set("v2", http.StatusOK)
+	expect("change:v1>v2")
+	set("", http.StatusNotFound)
+	expect("delete:v2")
+	set("v3", http.StatusOK)
+	expect("change:>v3")
+	set("", http.StatusInternalServerError)
+	expect("error")
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Error("unexpected run result:", err)
+	}
+}
@@ -0,0 +1,100 @@
+package tool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ResumableChunkSize UploadResumable 每个分片的大小
+var ResumableChunkSize int64 = 8 << 20
+
+// ResumableRetries 分片上传失败后最多重试的次数
+var ResumableRetries = 5
+
+// ResumableRetryWait 第一次重试前等待的时间，之后翻倍
+var ResumableRetryWait = time.Second
+
+type uploadSession struct {
+	ID     string
+	Offset int64
+}
+
+// UploadResumable 分片上传，网络中断时按服务端记录的偏移量续传，全部完成后提交，
+// 提交前目标内容不会变化。opts 作用于所有请求，IfMatch 等条件只在提交时生效
+func UploadResumable(target, key string, content io.ReadSeeker, opts ...RequestOption) error {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	base, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	withQuery := func(q url.Values) string {
+		u := *base
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	var session uploadSession
+	err = doSignedData("POST", withQuery(url.Values{"uploads": {""}}), key, nil, append([]RequestOption{
+		func(req *http.Request) { req.Header.Set("Upload-Length", strconv.FormatInt(size, 10)) },
+	}, opts...), &session)
+	if err != nil {
+		return err
+	}
+	sessionURL := withQuery(url.Values{"upload": {session.ID}})
+
+	chunk := make([]byte, minInt64(ResumableChunkSize, size))
+	retries, wait := 0, ResumableRetryWait
+	for session.Offset < size {
+		n := minInt64(int64(len(chunk)), size-session.Offset)
+		if _, err = content.Seek(session.Offset, io.SeekStart); err == nil {
+			_, err = io.ReadFull(content, chunk[:n])
+		}
+		if err != nil {
+			return err
+		}
+
+		offset := session.Offset
+		err = doSignedData("PATCH", sessionURL, key, bytes.NewReader(chunk[:n]), append([]RequestOption{
+			func(req *http.Request) { req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10)) },
+		}, opts...), &session)
+		if err == nil {
+			retries, wait = 0, ResumableRetryWait
+			continue
+		}
+
+		var respErr *ResponseError
+		if errors.As(err, &respErr) && respErr.Code != http.StatusConflict { //服务端拒绝，重试也没用
+			doSigned("DELETE", sessionURL, key, nil, opts)
+			return err
+		}
+		if retries >= ResumableRetries {
+			return err
+		}
+		retries++
+		time.Sleep(wait)
+		wait *= 2
+
+		//以服务端实际收到的为准，上一次请求可能已经成功但响应丢失
+		var current uploadSession
+		if doSignedData("GET", sessionURL, key, nil, opts, &current) == nil {
+			session.Offset = current.Offset
+		}
+	}
+
+	return doSigned("POST", withQuery(url.Values{"upload": {session.ID}, "commit": {""}}), key, nil, opts)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
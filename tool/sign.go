@@ -1,10 +1,20 @@
 package tool
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/horsley/svrkit"
@@ -13,6 +23,24 @@ import (
 // TimeSpan 签名验证容忍的时间窗口
 var TimeSpan = float64(10)
 
+// AllowLegacySign 是否接受旧版 Basic Auth 形式的签名
+var AllowLegacySign = true
+
+// UseSignV2 Upload、Delete 等客户端请求是否用 v2 签名，默认用旧版签名，服务端都升级后再打开
+var UseSignV2 = false
+
+// SignV2Scheme v2 签名的 Authorization 前缀
+const SignV2Scheme = "FAAS2-HMAC-SHA256"
+
+// ContentHashHeader v2 签名时携带请求体 sha256 的请求头
+const ContentHashHeader = "X-Faas-Content-Sha256"
+
+// KeyNameHeader 使用命名 key 签名时携带 key 名字的请求头，没有时服务端用路径的 key 校验
+const KeyNameHeader = "X-Faas-Key-Name"
+
+// Nonces 服务端已使用过的 nonce，防止 v2 签名在时间窗口内被重放
+var Nonces = NewNonceCache()
+
 // SignUpload 对上传请求签名
 func SignUpload(key string, req *http.Request) {
 	ts := fmt.Sprint(time.Now().Unix())
@@ -22,23 +50,230 @@ func SignUpload(key string, req *http.Request) {
 	req.SetBasicAuth(ts, sign)
 }
 
-// VerifySign 验证请求签名
+// SignRequest 用 v2 方案签名，覆盖 method、path、query、请求体哈希、时间戳和 nonce
+// 请求体会被读到内存计算哈希后重新装回，大文件请用 SignRequestSeeker
+func SignRequest(key string, req *http.Request) error {
+	body := []byte{}
+	if req.Body != nil && req.Body != http.NoBody {
+		bin, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = bin
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	contentHash := sha256.Sum256(body)
+	return signV2Request(key, req, contentHash[:])
+}
+
+// SignRequestSeeker 同 SignRequest，从 body 流式计算哈希后回到开头作为请求体，不缓存内容
+func SignRequestSeeker(key string, req *http.Request, body io.ReadSeeker) error {
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	req.Body = io.NopCloser(body)
+	req.GetBody = func() (io.ReadCloser, error) {
+		_, err := body.Seek(start, io.SeekStart)
+		return io.NopCloser(body), err
+	}
+	return signV2Request(key, req, h.Sum(nil))
+}
+
+func signV2Request(key string, req *http.Request, contentHash []byte) error {
+	nonceBin := make([]byte, 16)
+	if _, err := rand.Read(nonceBin); err != nil {
+		return err
+	}
+
+	ts := fmt.Sprint(time.Now().Unix())
+	nonce := hex.EncodeToString(nonceBin)
+
+	req.Header.Set(ContentHashHeader, hex.EncodeToString(contentHash))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Timestamp=%s, Nonce=%s, Signature=%s",
+		SignV2Scheme, ts, nonce, signV2(key, req, ts, nonce)))
+	return nil
+}
+
+// 签名校验失败的原因
+var (
+	ErrSignMissing        = errors.New("sign missing")
+	ErrSignLegacyDisabled = errors.New("legacy sign disabled")
+	ErrSignMalformed      = errors.New("sign malformed")
+	ErrSignExpired        = errors.New("sign expired")
+	ErrSignMismatch       = errors.New("sign mismatch")
+	ErrSignReplayed       = errors.New("sign nonce replayed")
+)
+
+// VerifySign 验证请求签名，v2 签名和旧版签名都接受
+// v2 签名通过后 req.Body 会被替换为校验内容哈希的 reader，读到结尾时哈希不符会返回错误
 func VerifySign(key string, req *http.Request) bool {
+	return CheckSign(key, req) == nil
+}
+
+// CheckSign 同 VerifySign，失败时返回原因
+func CheckSign(key string, req *http.Request) error {
+	return (&SignChecker{TimeSpan: TimeSpan, AllowLegacy: AllowLegacySign, Nonces: Nonces}).CheckSign(key, req)
+}
+
+// SignChecker 服务端校验签名的参数，同一进程中参数不同的多个服务各自持有一个，不用包级变量
+type SignChecker struct {
+	// TimeSpan 同包级 TimeSpan
+	TimeSpan float64
+	// AllowLegacy 同 AllowLegacySign
+	AllowLegacy bool
+	// Nonces 已使用过的 nonce
+	Nonces *NonceCache
+}
+
+// CheckSign 同包级 CheckSign，使用 c 的参数
+func (c *SignChecker) CheckSign(key string, req *http.Request) error {
+	if strings.HasPrefix(req.Header.Get("Authorization"), SignV2Scheme+" ") {
+		return c.checkSignV2(key, req)
+	}
+
 	ts, sign, ok := req.BasicAuth()
 	if !ok {
-		return false
+		return ErrSignMissing
+	}
+	if !c.AllowLegacy {
+		return ErrSignLegacyDisabled
 	}
 
 	target := svrkit.SHA1Hash(fmt.Sprint(ts, req.URL.Path, key, ts))
 	if sign != target {
-		return false
+		return ErrSignMismatch
 	}
 
+	if !inTimeSpan(ts, c.TimeSpan) {
+		return ErrSignExpired
+	}
+	return nil
+}
+
+func (c *SignChecker) checkSignV2(key string, req *http.Request) error {
+	params := map[string]string{}
+	for _, kv := range strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), SignV2Scheme+" "), ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(kv), "="); ok {
+			params[k] = v
+		}
+	}
+
+	ts, nonce, sign := params["Timestamp"], params["Nonce"], params["Signature"]
+	if ts == "" || nonce == "" || sign == "" {
+		return ErrSignMalformed
+	}
+	if !inTimeSpan(ts, c.TimeSpan) {
+		return ErrSignExpired
+	}
+
+	contentHash, err := hex.DecodeString(req.Header.Get(ContentHashHeader))
+	if err != nil || len(contentHash) != sha256.Size {
+		return ErrSignMalformed
+	}
+
+	if !hmac.Equal([]byte(sign), []byte(signV2(key, req, ts, nonce))) {
+		return ErrSignMismatch
+	}
+
+	if !c.Nonces.Use(nonce, time.Now().Add(2*time.Duration(c.TimeSpan*float64(time.Second)))) {
+		return ErrSignReplayed
+	}
+
+	body := req.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	req.Body = &hashVerifyReader{ReadCloser: body, hash: sha256.New(), expect: contentHash}
+	return nil
+}
+
+func signV2(key string, req *http.Request, ts, nonce string) string {
+	canonical := strings.Join([]string{
+		SignV2Scheme,
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		req.Header.Get(ContentHashHeader),
+		ts,
+		nonce,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func inTimeSpan(ts string, span float64) bool {
 	tsI64, err := strconv.ParseInt(ts, 10, 64)
 	if err != nil {
 		return false
 	}
 
 	diff := math.Abs(time.Since(time.Unix(tsI64, 0)).Seconds())
-	return diff <= TimeSpan
+	return diff <= span
+}
+
+// ErrContentHashMismatch 请求体和签名中的哈希不一致
+var ErrContentHashMismatch = errors.New("content hash mismatch")
+
+type hashVerifyReader struct {
+	io.ReadCloser
+	hash   hash.Hash
+	expect []byte
+}
+
+func (r *hashVerifyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.expect) {
+		return n, ErrContentHashMismatch
+	}
+	return n, err
+}
+
+// NonceCache 记录一段时间内用过的 nonce
+type NonceCache struct {
+	lock      sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewNonceCache 创建 NonceCache
+func NewNonceCache() *NonceCache {
+	return &NonceCache{seen: make(map[string]time.Time)}
+}
+
+// Use 标记 nonce 已使用直到 expire，返回 false 表示 nonce 已用过
+func (c *NonceCache) Use(nonce string, expire time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, v := range c.seen {
+			if v.Before(now) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if v, ok := c.seen[nonce]; ok && v.After(now) {
+		return false
+	}
+	c.seen[nonce] = expire
+	return true
 }
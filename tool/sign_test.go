@@ -0,0 +1,84 @@
+package tool
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSignRequest(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "https://abc.com/config/a.yaml?x=1", strings.NewReader("hello"))
+	if err := SignRequest(TestDirKey, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if VerifySign("other key", req) {
+		t.Error("wrong key accepted")
+	}
+
+	if !VerifySign(TestDirKey, req) {
+		t.Fatal("valid sign rejected")
+	}
+	if bin, err := io.ReadAll(req.Body); err != nil || string(bin) != "hello" {
+		t.Error("body not readable after verify", string(bin), err)
+	}
+
+	if VerifySign(TestDirKey, req) {
+		t.Error("replayed nonce accepted")
+	}
+}
+
+func TestSignRequestSeeker(t *testing.T) {
+	body := strings.NewReader("hello")
+	req, _ := http.NewRequest("PUT", "https://abc.com/config/a.yaml", body)
+	if err := SignRequestSeeker(TestDirKey, req, body); err != nil {
+		t.Fatal(err)
+	}
+	if !VerifySign(TestDirKey, req) {
+		t.Fatal("valid sign rejected")
+	}
+	if bin, err := io.ReadAll(req.Body); err != nil || string(bin) != "hello" {
+		t.Error("body not readable after verify", string(bin), err)
+	}
+}
+
+func TestSignRequest_Tampered(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "https://abc.com/config/a.yaml", strings.NewReader("hello"))
+	SignRequest(TestDirKey, req)
+	req.Method = "DELETE"
+	if VerifySign(TestDirKey, req) {
+		t.Error("method change accepted")
+	}
+
+	req, _ = http.NewRequest("PUT", "https://abc.com/config/a.yaml", strings.NewReader("hello"))
+	SignRequest(TestDirKey, req)
+	req.URL.RawQuery = "rollback=1"
+	if VerifySign(TestDirKey, req) {
+		t.Error("query change accepted")
+	}
+
+	req, _ = http.NewRequest("PUT", "https://abc.com/config/a.yaml", strings.NewReader("hello"))
+	SignRequest(TestDirKey, req)
+	req.Body = io.NopCloser(strings.NewReader("evil"))
+	if !VerifySign(TestDirKey, req) {
+		t.Fatal("sign rejected")
+	}
+	if _, err := io.ReadAll(req.Body); err != ErrContentHashMismatch {
+		t.Error("body change not detected", err)
+	}
+}
+
+func TestVerifySign_Legacy(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "https://abc.com/config/a.yaml", nil)
+	SignUpload(TestDirKey, req)
+	if !VerifySign(TestDirKey, req) {
+		t.Error("legacy sign rejected")
+	}
+
+	AllowLegacySign = false
+	defer func() { AllowLegacySign = true }()
+	if VerifySign(TestDirKey, req) {
+		t.Error("legacy sign accepted when disabled")
+	}
+}
@@ -0,0 +1,213 @@
+package tool
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WatchHeader 服务端支持 watch 时在响应中带上，客户端据此判断是否需要退回轮询
+const WatchHeader = "X-Faas-Watch"
+
+// WatchWait 每次长轮询等待的时长
+var WatchWait = 30 * time.Second
+
+// WatchFallbackInterval 服务端不支持 watch 时退回轮询的间隔，也是出错重试退避的上限
+var WatchFallbackInterval = 10 * time.Second
+
+var errWatchUnsupported = errors.New("watch not supported by server")
+
+// Watcher 通过服务端长轮询等待内容变更，用 Run 启动，ctx 取消后退出，服务端不支持 watch 时退回 Poller
+type Watcher struct {
+	URL string
+
+	// Client 为空时使用超时为 WatchWait+DefaultPollTimeout 的 client，自定义时超时需长于 WatchWait
+	Client *http.Client
+
+	// Username Password 访问有 basic_auth 的路径时使用
+	Username string
+	Password string
+
+	// OnChange 内容变化时回调
+	OnChange func(old, new []byte)
+	// OnError 出错时回调，为空则打日志
+	OnError func(err error)
+
+	lastBin []byte
+	etag    string
+}
+
+// Run 开始监听，阻塞直到 ctx 结束
+func (w *Watcher) Run(ctx context.Context) error {
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: WatchWait + DefaultPollTimeout}
+	}
+
+	failures := 0
+	for {
+		err := w.watchOnce(ctx, client)
+		if errors.Is(err, errWatchUnsupported) {
+			log.Println("Watch not supported by server, fallback to poll")
+			return w.fallback(ctx, client)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		w.reportError(err)
+		failures++
+		timer := time.NewTimer(backoff(time.Second, WatchFallbackInterval, failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// fallback 退回定时轮询，轮询拿到的首个内容和已知内容不同时也回调 OnChange
+func (w *Watcher) fallback(ctx context.Context, client *http.Client) error {
+	p := &Poller{
+		URL:      w.URL,
+		Interval: WatchFallbackInterval,
+		Client:   client,
+		Username: w.Username,
+		Password: w.Password,
+		OnInit: func(content []byte) {
+			if w.lastBin != nil && !bytes.Equal(w.lastBin, content) && w.OnChange != nil {
+				w.OnChange(w.lastBin, content)
+			}
+		},
+		OnChange: w.OnChange,
+		OnError:  w.OnError,
+	}
+	return p.Run(ctx)
+}
+
+func (w *Watcher) reportError(err error) {
+	if w.OnError != nil {
+		w.OnError(err)
+		return
+	}
+	log.Println("Watch got error:", err)
+}
+
+func (w *Watcher) watchOnce(ctx context.Context, client *http.Client) error {
+	if w.lastBin == nil {
+		bin, err := w.fetchContent(ctx, client)
+		if err != nil {
+			return err
+		}
+		w.lastBin, w.etag = bin, contentETag(bin)
+	}
+
+	changed, err := w.waitChange(ctx, client)
+	if err != nil || !changed {
+		return err
+	}
+
+	bin, err := w.fetchContent(ctx, client)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(w.lastBin, bin) && w.OnChange != nil {
+		w.OnChange(w.lastBin, bin)
+	}
+	w.lastBin, w.etag = bin, contentETag(bin)
+	return nil
+}
+
+func (w *Watcher) newRequest(ctx context.Context, target string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if w.Username != "" || w.Password != "" {
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+	return req, nil
+}
+
+// waitChange 长轮询一次，服务端没有返回 WatchHeader 时返回 errWatchUnsupported
+func (w *Watcher) waitChange(ctx context.Context, client *http.Client) (bool, error) {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return false, err
+	}
+	q := u.Query()
+	q.Set("watch", "1")
+	q.Set("wait", WatchWait.String())
+	q.Set("etag", w.etag)
+	u.RawQuery = q.Encode()
+
+	req, err := w.newRequest(ctx, u.String())
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.Header.Get(WatchHeader) == "" {
+		if resp.StatusCode == http.StatusOK { //旧版服务端忽略 watch 参数，直接返回内容
+			return false, errWatchUnsupported
+		}
+		return false, &httpError{resp.StatusCode}
+	}
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+func (w *Watcher) fetchContent(ctx context.Context, client *http.Client) ([]byte, error) {
+	req, err := w.newRequest(ctx, w.URL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bin, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpError{resp.StatusCode}
+	}
+	return bin, nil
+}
+
+// Watch 监听 URL 的内容变更，阻塞直到 ctx 结束，需要认证、自定义 client 或更多回调请用 Watcher
+func Watch(ctx context.Context, target string, onChange func(old, new []byte)) error {
+	return (&Watcher{URL: target, OnChange: onChange}).Run(ctx)
+}
+
+type httpError struct {
+	code int
+}
+
+func (e *httpError) Error() string {
+	return "http error: " + http.StatusText(e.code)
+}
+
+func contentETag(bin []byte) string {
+	sum := sha256.Sum256(bin)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
@@ -0,0 +1,71 @@
+package tool
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	oldInterval := WatchFallbackInterval
+	WatchFallbackInterval = 10 * time.Millisecond
+	defer func() { WatchFallbackInterval = oldInterval }()
+
+	for _, supported := range []bool{true, false} {
+		var lock sync.Mutex
+		content := "v1"
+		svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			lock.Lock()
+			defer lock.Unlock()
+			if supported && r.URL.Query().Has("watch") {
+				rw.Header().Set(WatchHeader, "1")
+				if r.URL.Query().Get("etag") == contentETag([]byte(content)) {
+					rw.WriteHeader(http.StatusNotModified)
+				}
+				return
+			}
+			io.WriteString(rw, content)
+		}))
+
+		events := make(chan string, 10)
+		w := &Watcher{
+			URL:      svr.URL,
+			Client:   svr.Client(),
+			Username: "user",
+			Password: "pass",
+			OnChange: func(old, new []byte) { events <- string(old) + ">" + string(new) },
+			OnError:  func(err error) { t.Log("watch error:", err) },
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- w.Run(ctx) }()
+
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		content = "v2"
+		lock.Unlock()
+		select {
+		case got := <-events:
+			if got != "v1>v2" {
+				t.Errorf("supported=%v: got event %q", supported, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("supported=%v: change not detected", supported)
+		}
+
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("supported=%v: unexpected run result: %v", supported, err)
+		}
+		svr.Close()
+	}
+}
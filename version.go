@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horsley/svrkit"
+)
+
+const versionSubDir = "versions"
+
+// versionIDLayout 版本号即归档时间，字典序就是时间序
+const versionIDLayout = "20060102T150405.000000000"
+
+type contentVersion struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+// KeepVersions 保留的历史版本数，0 表示不保留
+func (p *pathMeta) KeepVersions() int {
+	v, ok := p.GetText(MetaVersions, true)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(v))
+	return n
+}
+
+// versionDir 历史版本目录，按路径哈希平铺，避免和子路径重名
+func (p *pathMeta) versionDir() string {
+	if !p.Valid() {
+		return ""
+	}
+	return path.Join(versionSubDir, svrkit.SHA1Hash(p.Path()))
+}
+
+// archive 把当前内容存为一个历史版本并清理超出数量的旧版本
+func (p *pathMeta) archive(keep int) error {
+	f, err := p.OpenContent()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	err = p.srv.storage.WriteFile(path.Join(p.versionDir(), time.Now().UTC().Format(versionIDLayout)), f)
+	if err != nil {
+		return err
+	}
+
+	versions, err := p.Versions()
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(versions); i++ {
+		p.srv.storage.Remove(path.Join(p.versionDir(), versions[i].ID))
+	}
+	return nil
+}
+
+// Versions 历史版本列表，新的在前
+func (p *pathMeta) Versions() ([]contentVersion, error) {
+	entries, err := p.srv.storage.ReadDir(p.versionDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []contentVersion
+	for _, info := range entries {
+		if info.IsDir() {
+			continue
+		}
+		result = append(result, contentVersion{ID: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID > result[j].ID
+	})
+	return result, nil
+}
+
+// VersionName 指定历史版本在存储后端中的名字
+func (p *pathMeta) VersionName(id string) (string, bool) {
+	if _, err := time.Parse(versionIDLayout, id); err != nil {
+		return "", false
+	}
+	versionName := path.Join(p.versionDir(), id)
+	if _, err := p.srv.storage.Stat(versionName); err != nil {
+		return "", false
+	}
+	return versionName, true
+}
+
+// Rollback 回滚到指定历史版本，当前内容也会被归档
+func (p *pathMeta) Rollback(id string) error {
+	versionName, ok := p.VersionName(id)
+	if !ok {
+		return errors.New("版本不存在")
+	}
+
+	f, err := p.srv.storage.Open(versionName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return p.SaveContent(f)
+}
+
+// readAccessKeys 读权限相关的 meta，软删除后仍要保护历史版本
+var readAccessKeys = []MetaKey{MetaReadAuth, MetaIPCheck, MetaIPGroups, MetaClientCert}
+
+// SoftDestroy 删除内容和 meta，但开启了版本保留时把当前内容归档，可回滚恢复。
+// 此时保留子树中读权限相关的 meta，否则 ?versions 和 ?version= 会把受保护的历史版本公开；
+// 不保留版本时连同之前留下的历史版本一起删除
+func (p *pathMeta) SoftDestroy() error {
+	keep := p.KeepVersions()
+	if keep <= 0 {
+		return p.Destroy()
+	}
+
+	if err := p.archive(keep); err != nil {
+		return err
+	}
+	err := walkStorage(p.srv.storage, p.metaName, func(name string, info fs.FileInfo) error {
+		if isReadAccessKey(info.Name()) {
+			return nil
+		}
+		return p.srv.storage.Remove(name)
+	})
+	if err != nil {
+		return err
+	}
+	return p.removeContent()
+}
+
+func isReadAccessKey(name string) bool {
+	for _, k := range readAccessKeys {
+		if name == string(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropFileMeta 文件已被删掉后清理它自己的 meta，不动子路径的；和 SoftDestroy 一样，
+// 保留版本时留下读权限相关的 meta，不保留时连同历史版本一起删除
+func (p *pathMeta) dropFileMeta(keep int) error {
+	entries, err := p.srv.storage.ReadDir(p.metaName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, info := range entries {
+		if info.IsDir() || (keep > 0 && isReadAccessKey(info.Name())) {
+			continue
+		}
+		if err := p.srv.storage.Remove(path.Join(p.metaName, info.Name())); err != nil {
+			return err
+		}
+	}
+	p.srv.expiries.Track(p.Path(), time.Time{})
+	if keep > 0 {
+		return nil
+	}
+	return p.srv.storage.RemoveAll(p.versionDir())
+}
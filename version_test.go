@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+func TestVersions(t *testing.T) {
+	p := testServer.MetaOf("/version_test")
+	p.Set(MetaVersions, []byte("2"))
+	defer p.Destroy()
+
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		if err := p.SaveContent(strings.NewReader(content)); err != nil {
+			t.Fatal("save err", err)
+		}
+	}
+
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/version_test?versions", nil)
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+
+	var resp struct {
+		Data []contentVersion
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Data) != 2 {
+		t.Fatal("unexpected versions:", rec.Body.String())
+	}
+
+	mockReq, _ = http.NewRequest("GET", "http://abc.com/version_test?version="+resp.Data[1].ID, nil)
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if rec.Body.String() != "v2" {
+		t.Error("unexpected version content:", rec.Body.String())
+	}
+
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ = http.NewRequest("POST", "http://abc.com/version_test?rollback="+resp.Data[1].ID, nil)
+	tool.SignUpload(peekRootKey, mockReq)
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if rec.Body.String() != `{"Code":0,"Data":null,"Message":""}` {
+		t.Error("unexpected rollback result:", rec.Body.String())
+	}
+	if content := readContent(p); content != "v2" {
+		t.Error("rollback content not match:", content)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	testServer.MetaOf("/soft_delete").Set(MetaVersions, []byte("3"))
+	p := testServer.MetaOf("/soft_delete/file")
+	p.SaveContent(strings.NewReader("keep me"))
+	defer testServer.MetaOf("/soft_delete").Destroy()
+	defer p.Destroy()
+
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ := http.NewRequest("DELETE", "http://abc.com/soft_delete/file", nil)
+	tool.SignUpload(peekRootKey, mockReq)
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+
+	if _, err := p.StatContent(); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("content not deleted")
+	}
+
+	versions, _ := p.Versions()
+	if len(versions) != 1 {
+		t.Fatal("deleted content not archived")
+	}
+
+	if err := p.Rollback(versions[0].ID); err != nil {
+		t.Error("restore err", err)
+	}
+	if content := readContent(p); content != "keep me" {
+		t.Error("restored content not match:", content)
+	}
+}
+
+func TestSoftDelete_KeepNone(t *testing.T) {
+	p := testServer.MetaOf("/soft_delete_none/file")
+	p.Set(MetaVersions, []byte("3"))
+	p.SaveContent(strings.NewReader("v1"))
+	p.SaveContent(strings.NewReader("v2"))
+	defer testServer.MetaOf("/soft_delete_none").Destroy()
+	if versions, _ := p.Versions(); len(versions) != 1 {
+		t.Fatal("content not archived")
+	}
+
+	//关掉版本保留后删除，之前的历史版本也一并清理
+	p.Set(MetaVersions, []byte("0"))
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ := http.NewRequest("DELETE", "http://abc.com/soft_delete_none/file", nil)
+	tool.SignUpload(peekRootKey, mockReq)
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: httptest.NewRecorder()}, &svrkit.Request{Request: mockReq})
+
+	if _, err := p.StatContent(); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("content not deleted")
+	}
+	if _, err := testServer.storage.Stat(p.versionDir()); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("version dir left behind:", err)
+	}
+}
+
+func TestSoftDelete_KeepAccess(t *testing.T) {
+	p := testServer.MetaOf("/soft_delete_auth/file")
+	p.Set(MetaVersions, []byte("3"))
+	p.SetBasicAuth(map[string]string{"user": "pass"})
+	p.SaveContent(strings.NewReader("TOPSECRET"))
+	defer testServer.MetaOf("/soft_delete_auth").Destroy()
+	defer p.Destroy()
+
+	peekRootKey, _ := testServer.MetaOf("/").WriteKey()
+	mockReq, _ := http.NewRequest("DELETE", "http://abc.com/soft_delete_auth/file", nil)
+	tool.SignUpload(peekRootKey, mockReq)
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: httptest.NewRecorder()}, &svrkit.Request{Request: mockReq})
+
+	versions, _ := p.Versions()
+	if len(versions) != 1 {
+		t.Fatal("deleted content not archived")
+	}
+	if _, ok := p.Get(MetaVersions, false); ok {
+		t.Error("other meta kept after soft delete")
+	}
+
+	for _, query := range []string{"versions", "version=" + versions[0].ID} {
+		mockReq, _ = http.NewRequest("GET", "http://abc.com/soft_delete_auth/file?"+query, nil)
+		rec := httptest.NewRecorder()
+		testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+		if rec.Code != http.StatusUnauthorized || strings.Contains(rec.Body.String(), "TOPSECRET") {
+			t.Error("history readable without basic auth:", query, rec.Code)
+		}
+
+		mockReq.SetBasicAuth("user", "pass")
+		rec = httptest.NewRecorder()
+		testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+		if rec.Code != http.StatusOK {
+			t.Error("history not readable with basic auth:", query, rec.Code)
+		}
+	}
+}
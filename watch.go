@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horsley/faas/tool"
+	"github.com/horsley/svrkit"
+)
+
+const (
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+const defaultWatchWait = 30 * time.Second
+const maxWatchWait = 5 * time.Minute
+const sseHeartbeat = 15 * time.Second
+
+type changeEvent struct {
+	Path string
+	Op   string
+	ETag string `json:",omitempty"`
+}
+
+// changeHub 内容变更的订阅分发，订阅某路径会收到它及其子树的变更
+type changeHub struct {
+	lock      sync.Mutex
+	subs      map[chan changeEvent]string
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{
+		subs: make(map[chan changeEvent]string),
+		done: make(chan struct{}),
+	}
+}
+
+func (h *changeHub) Subscribe(path string) chan changeEvent {
+	ch := make(chan changeEvent, 16)
+	h.lock.Lock()
+	h.subs[ch] = path
+	h.lock.Unlock()
+	return ch
+}
+
+func (h *changeHub) Unsubscribe(ch chan changeEvent) {
+	h.lock.Lock()
+	delete(h.subs, ch)
+	h.lock.Unlock()
+}
+
+// Publish 通知订阅者，订阅者处理不过来时丢弃，不阻塞写入
+func (h *changeHub) Publish(ev changeEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for ch, path := range h.subs {
+		if path == "/" || ev.Path == path || strings.HasPrefix(ev.Path, path+"/") {
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// Close 通知所有 watch 请求结束，停机时调用，否则长连接会拖到停机超时
+func (h *changeHub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// Done 停机时关闭
+func (h *changeHub) Done() <-chan struct{} {
+	return h.done
+}
+
+// watchHandler 等待路径或子树变更，Accept: text/event-stream 时用 SSE 持续推送，否则长轮询。
+// 子树中有自己读权限的路径，和打包下载一样逐个检查，请求者读不了的变更不推送，避免泄露文件名和内容哈希
+func (s *server) watchHandler(rw *svrkit.ResponseWriter, r *svrkit.Request, targetMeta *pathMeta) {
+	ch := s.changes.Subscribe(targetMeta.Path())
+	defer s.changes.Unsubscribe(ch)
+	checker := s.newReadChecker(r)
+
+	rw.Header().Set(tool.WatchHeader, "1")
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.watchSSE(rw, r, ch, checker)
+		return
+	}
+
+	wait := defaultWatchWait
+	if d, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil && d > 0 {
+		wait = d
+	}
+	if wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+
+	//客户端带了 etag 且已经过时，立即返回，不必等下一次变更
+	if etag := r.URL.Query().Get("etag"); etag != "" {
+		current, ok := contentETag(targetMeta)
+		if !ok && !targetMeta.IsDir() {
+			rw.WriteCommonResponse(0, "", changeEvent{Path: targetMeta.Path(), Op: ChangeDelete})
+			return
+		}
+		if ok && current != etag {
+			rw.WriteCommonResponse(0, "", changeEvent{Path: targetMeta.Path(), Op: ChangeUpdate, ETag: current})
+			return
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ev := <-ch:
+			if !checker.Allowed(s.MetaOf(ev.Path)) {
+				continue
+			}
+			rw.WriteCommonResponse(0, "", ev)
+		case <-timer.C:
+			rw.WriteHeader(http.StatusNotModified)
+		case <-s.changes.Done(): //客户端会重新发起，连到新的实例
+			rw.WriteHeader(http.StatusNotModified)
+		case <-r.Context().Done():
+		}
+		return
+	}
+}
+
+func (s *server) watchSSE(rw *svrkit.ResponseWriter, r *svrkit.Request, ch chan changeEvent, checker *readChecker) {
+	flusher, ok := rw.ResponseWriter.(http.Flusher)
+	if !ok {
+		rw.HTTPError(http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-ch:
+			if !checker.Allowed(s.MetaOf(ev.Path)) {
+				continue
+			}
+			bin, _ := json.Marshal(ev)
+			fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", ev.Op, bin)
+		case <-ticker.C:
+			fmt.Fprint(rw, ": ping\n\n")
+		case <-s.changes.Done():
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horsley/svrkit"
+)
+
+func TestWatchLongPoll(t *testing.T) {
+	p := testServer.MetaOf("/watch_test/file")
+	p.SaveContent(strings.NewReader("v1"))
+	defer testServer.MetaOf("/watch_test").Destroy()
+	defer p.Destroy()
+
+	etag, _ := contentETag(p)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		p.SaveContent(strings.NewReader("v2"))
+	}()
+
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/watch_test?watch&wait=5s", nil)
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+
+	var resp struct {
+		Data changeEvent
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data.Path != "/watch_test/file" || resp.Data.Op != ChangeUpdate {
+		t.Fatal("unexpected event:", rec.Body.String())
+	}
+
+	newETag, _ := contentETag(p)
+	if resp.Data.ETag != newETag || newETag == etag {
+		t.Error("etag not match", resp.Data.ETag, newETag)
+	}
+
+	mockReq, _ = http.NewRequest("GET", "http://abc.com/watch_test/file?watch&wait=5s&etag="+etag, nil)
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data.ETag != newETag {
+		t.Error("stale etag not returned at once:", rec.Body.String())
+	}
+
+	mockReq, _ = http.NewRequest("GET", "http://abc.com/watch_test/file?watch&wait=50ms&etag="+newETag, nil)
+	rec = httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+	if rec.Code != http.StatusNotModified {
+		t.Error("timeout not 304:", rec.Code)
+	}
+}
+
+func TestWatchLongPoll_ProtectedChild(t *testing.T) {
+	defer testServer.MetaOf("/watch_protected").Destroy()
+	secret := testServer.MetaOf("/watch_protected/secret/file")
+	testServer.MetaOf("/watch_protected/secret").SetBasicAuth(map[string]string{"user": "pass"})
+	public := testServer.MetaOf("/watch_protected/public")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		secret.SaveContent(strings.NewReader("TOPSECRET"))
+		time.Sleep(50 * time.Millisecond)
+		public.SaveContent(strings.NewReader("hello"))
+	}()
+
+	//上级路径可读，但子路径有自己的 basic_auth，它的变更不能推给这个订阅者
+	mockReq, _ := http.NewRequest("GET", "http://abc.com/watch_protected?watch&wait=5s", nil)
+	rec := httptest.NewRecorder()
+	testServer.handleRequest(&svrkit.ResponseWriter{ResponseWriter: rec}, &svrkit.Request{Request: mockReq})
+
+	var resp struct {
+		Data changeEvent
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data.Path != "/watch_protected/public" {
+		t.Error("protected change leaked to parent watcher:", rec.Body.String())
+	}
+}
+
+func TestWatchSSE(t *testing.T) {
+	p := testServer.MetaOf("/watch_sse/file")
+	defer testServer.MetaOf("/watch_sse").Destroy()
+
+	svr := httptest.NewServer(testServer)
+	defer svr.Close()
+
+	req, _ := http.NewRequest("GET", svr.URL+"/watch_sse?watch", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	p.SaveContent(strings.NewReader("v1"))
+	p.Destroy()
+
+	var events []string
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() && len(events) < 2 {
+		if strings.HasPrefix(s.Text(), "event: ") {
+			events = append(events, strings.TrimPrefix(s.Text(), "event: "))
+		}
+	}
+	if strings.Join(events, ",") != "update,delete" {
+		t.Error("unexpected events:", events)
+	}
+}